@@ -14,20 +14,35 @@ import (
 
 const (
 	LOCKFILE   = "barrel.lock"
-	HINTS_FILE = "barrel.hints"
+	HINTS_FILE = "barrel_%d.hint"
+	MERGE_DIR  = "merge" // Directory inside the data directory where the merged datafiles are staged.
 )
 
+// Barrel is the datastore. Reads and writes are served concurrently while holding
+// the read lock, and only lock the shard of the keydir which holds the key. The write
+// lock is taken for replacing the datafiles, like when the active datafile is rotated.
 type Barrel struct {
-	sync.Mutex
+	sync.RWMutex
 
 	lo      logf.Logger
 	bufPool sync.Pool // Pool of byte buffers used for writing.
 	opts    *Options
 
-	keydir KeyDir                     // In-memory hashmap of all active keys.
+	keydir *KeyDir                    // In-memory hashmap of all active keys.
+	wmu    sync.Mutex                 // Serializes the appends to the active datafile.
 	df     *datafile.DataFile         // Active datafile.
 	stale  map[int]*datafile.DataFile // Map of older datafiles with their IDs.
 	flockF *os.File                   //Lockfile to prevent multiple write access to same datafile.
+
+	mergeMu sync.Mutex // Ensures only one merge runs at a time.
+
+	closed bool           // Whether the datastore is shut down. Guarded by the lock.
+	done   chan struct{}  // Closed on shutdown to stop the background goroutines.
+	wg     sync.WaitGroup // Background goroutines started by Init.
+
+	pinMu   sync.Mutex
+	pins    map[*datafile.DataFile]int  // Number of snapshots using each datafile.
+	retired map[*datafile.DataFile]bool // Datafiles which are closed once they're not pinned by any snapshot.
 }
 
 // initLogger initializes logger instance.
@@ -54,19 +69,42 @@ func Init(cfg ...Config) (*Barrel, error) {
 		index  = 0
 		flockF *os.File
 		stale  = map[int]*datafile.DataFile{}
+		err    error
 	)
 
+	// If not running in a read only mode then create a lockfile to ensure only one process writes to the db directory.
+	// The lock is taken before opening the datafiles, since opening them can write to them.
+	if !opts.readOnly {
+		// Check if a lockfile already exists.
+		lockPath := filepath.Join(opts.dir, LOCKFILE)
+		if exists(lockPath) {
+			return nil, ErrLocked
+		} else {
+			flockF, err = createFlockFile(lockPath)
+			if err != nil {
+				return nil, fmt.Errorf("error creating lockfile: %w", err)
+			}
+		}
+	}
+
+	// Release the datafiles and the lockfile if the datastore can't be initialised,
+	// so that it can be opened again once the error is fixed.
+	fail := func(err error) (*Barrel, error) {
+		closeAll(stale, flockF)
+		return nil, err
+	}
+
 	// Load existing datafiles
 	files, err := getDataFiles(opts.dir)
 	if err != nil {
-		return nil, fmt.Errorf("error loading data files: %w", err)
+		return fail(fmt.Errorf("error loading data files: %w", err))
 	}
 
 	if len(files) > 0 {
 		// Get the existing ids.
 		ids, err := getIDs(files)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing ids for existing files: %w", err)
+			return fail(fmt.Errorf("error parsing ids for existing files: %w", err))
 		}
 
 		// Increment the index to write to a new datafile.
@@ -74,84 +112,116 @@ func Init(cfg ...Config) (*Barrel, error) {
 
 		// Add all older datafiles to the list of stale files.
 		for _, idx := range ids {
-			df, err := datafile.New(opts.dir, idx)
+			df, err := openDataFile(opts, opts.dir, idx)
 			if err != nil {
-				return nil, err
+				return fail(err)
 			}
 			stale[idx] = df
 		}
 	}
 
-	// If not running in a read only mode then create a lockfile to ensure only one process writes to the db directory.
+	// Discard the output of a merge which was interrupted before it was published.
+	// The merged datafiles are only removed once the output is published, so no data is lost.
 	if !opts.readOnly {
-		// Check if a lockfile already exists.
-		lockPath := filepath.Join(opts.dir, LOCKFILE)
-		if exists(lockPath) {
-			return nil, ErrLocked
-		} else {
-			flockF, err = createFlockFile(lockPath)
-			if err != nil {
-				return nil, fmt.Errorf("error creating lockfile: %w", err)
-			}
+		if err := os.RemoveAll(filepath.Join(opts.dir, MERGE_DIR)); err != nil {
+			return fail(fmt.Errorf("error removing incomplete merge: %w", err))
 		}
 	}
 
 	// Initialise a db store.
-	df, err := datafile.New(opts.dir, index)
+	df, err := openDataFile(opts, opts.dir, index)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
-	// Initialise an empty keydir.
-	keydir := make(KeyDir, 0)
-
-	// Check if a hints file already exists and then use that to populate the hashtable.
-	hintsPath := filepath.Join(opts.dir, HINTS_FILE)
-	if exists(hintsPath) {
-		if err := keydir.Decode(hintsPath); err != nil {
-			return nil, fmt.Errorf("error populating hashtable from hints file: %w", err)
-		}
-	}
-
-	// Initialise barrel.
+	// Initialise barrel with an empty keydir.
 	barrel := &Barrel{
-		opts:   opts,
-		lo:     lo,
-		df:     df,
-		stale:  stale,
-		flockF: flockF,
-		keydir: keydir,
+		opts:    opts,
+		lo:      lo,
+		df:      df,
+		stale:   stale,
+		flockF:  flockF,
+		keydir:  newKeyDir(opts.shards, opts.orderedIndex),
+		pins:    make(map[*datafile.DataFile]int),
+		retired: make(map[*datafile.DataFile]bool),
+		done:    make(chan struct{}),
 		bufPool: sync.Pool{New: func() any {
 			return bytes.NewBuffer([]byte{})
 		}},
 	}
 
-	// Spawn a goroutine which runs in background and compacts all datafiles in a new single datafile.
-	go barrel.RunCompaction(opts.compactInterval)
+	// Populate the hashtable from the hints file and replay the records
+	// which were written after it was generated.
+	if err := barrel.loadKeyDir(); err != nil {
+		df.Close()
+		return fail(fmt.Errorf("error populating hashtable: %w", err))
+	}
+
+	// Spawn a goroutine which runs in background and merges the stale datafiles into new datafiles.
+	barrel.background(func() { barrel.RunCompaction(opts.compactInterval) })
 
 	// Spawn a goroutine which checks for the file size of the active file at periodic interval.
-	go barrel.ExamineFileSize(barrel.opts.checkFileSizeInterval)
+	barrel.background(func() { barrel.ExamineFileSize(barrel.opts.checkFileSizeInterval) })
 
 	// Spawn a goroutine which flushes the file to disk periodically.
 	if barrel.opts.syncInterval != nil {
-		go barrel.SyncFile(*opts.syncInterval)
+		barrel.background(func() { barrel.SyncFile(*opts.syncInterval) })
 	}
 
 	return barrel, nil
 }
 
+// closeAll closes the given datafiles and removes the lockfile, if any.
+// It's used for cleaning up when Init fails, so the errors are ignored.
+func closeAll(dfs map[int]*datafile.DataFile, flockF *os.File) {
+	for _, df := range dfs {
+		df.Close()
+	}
+	if flockF != nil {
+		destroyFlockFile(flockF)
+	}
+}
+
+// background runs fn in a goroutine which Shutdown waits for.
+func (b *Barrel) background(fn func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		fn()
+	}()
+}
+
 // Shutdown closes all the open file descriptors and removes any file locks.
 // If non running in a read-only mode, it's essential to call close so that it
 // removes any file locks on the database directory. Not calling close will prevent
 // future startups until it's removed manually.
+// The background goroutines are stopped and a running merge is waited for before
+// closing the datafiles, so nothing is written to the directory after the lock is removed.
 func (b *Barrel) Shutdown() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	b.Unlock()
+
+	close(b.done)
+	b.wg.Wait()
+
+	// Merges started by the caller hold the merge lock till they're done.
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
 	b.Lock()
 	defer b.Unlock()
 
-	// Generate a hints file.
-	if err := b.generateHints(); err != nil {
-		b.lo.Error("error generating hints file", "error", err)
-		return err
+	// Generate a hints file for the active datafile.
+	if !b.opts.readOnly {
+		if err := b.generateHints(b.df); err != nil {
+			b.lo.Error("error generating hints file", "error", err)
+			return err
+		}
 	}
 
 	// Close all active file handlers.
@@ -168,6 +238,16 @@ func (b *Barrel) Shutdown() error {
 		}
 	}
 
+	// Close the merged datafiles which are still pinned by snapshots.
+	b.pinMu.Lock()
+	for df := range b.retired {
+		if err := df.Close(); err != nil {
+			b.lo.Error("error closing merged db file", "error", err, "id", df.ID())
+		}
+	}
+	b.retired = make(map[*datafile.DataFile]bool)
+	b.pinMu.Unlock()
+
 	// Cleanup the lock file.
 	if !b.opts.readOnly {
 		if err := destroyFlockFile(b.flockF); err != nil {
@@ -184,8 +264,8 @@ func (b *Barrel) Shutdown() error {
 // This metadata helps for faster reads as the last position of the file is recorded so only
 // a single disk seek is required to read value.
 func (b *Barrel) Put(k string, val []byte) error {
-	b.Lock()
-	defer b.Unlock()
+	b.RLock()
+	defer b.RUnlock()
 
 	if b.opts.readOnly {
 		return ErrReadOnly
@@ -202,8 +282,8 @@ func (b *Barrel) Put(k string, val []byte) error {
 
 // PutEx is same as Put but also takes an additional expiry time.
 func (b *Barrel) PutEx(k string, val []byte, ex time.Duration) error {
-	b.Lock()
-	defer b.Unlock()
+	b.RLock()
+	defer b.RUnlock()
 
 	if b.opts.readOnly {
 		return ErrReadOnly
@@ -225,35 +305,37 @@ func (b *Barrel) PutEx(k string, val []byte, ex time.Duration) error {
 // Using the offset present in metadata it finds the record in the datafile with a single disk seek.
 // It further decodes the record and returns the value as a byte array for the given key.
 func (b *Barrel) Get(k string) ([]byte, error) {
-	b.Lock()
-	defer b.Unlock()
+	b.RLock()
+	defer b.RUnlock()
 
 	b.lo.Debug("fetching data", "key", k)
-	record, err := b.get(k)
-	if err != nil {
-		return nil, err
+
+	meta, ok := b.keydir.Get(k)
+	if !ok {
+		return nil, ErrNoKey
 	}
 
-	// If expired, then don't return any result.
-	if record.isExpired() {
+	// If expired, then don't return any result. The expiry is checked
+	// in the keydir, so no disk read is required for expired keys.
+	if meta.isExpired() {
 		return nil, ErrExpiredKey
 	}
 
-	// If invalid checksum, return error.
-	if !record.isValidChecksum() {
-		return nil, ErrChecksumMismatch
+	record, err := b.read(k, meta)
+	if err != nil {
+		return nil, err
 	}
 
-	return record.Value, nil
+	return record.value()
 }
 
-// Delete creates a tombstone record for the given key. The tombstone value is simply an empty byte array.
+// Delete creates a tombstone record for the given key. The tombstone is marked with a flag in the record header.
 // Actual deletes happen in background when merge is called.
 // Since the file is opened in append-only mode, the new value of the key
 // is overwritten both on disk and in memory as a tombstone record.
 func (b *Barrel) Delete(k string) error {
-	b.Lock()
-	defer b.Unlock()
+	b.RLock()
+	defer b.RUnlock()
 
 	if b.opts.readOnly {
 		return ErrReadOnly
@@ -264,45 +346,48 @@ func (b *Barrel) Delete(k string) error {
 }
 
 // List iterates over all keys and returns the list of keys.
+// Expired keys which haven't been cleaned up yet are skipped.
+// The keys are listed from a snapshot, so writes aren't blocked while listing.
+// Use ListPage to list the keys of large datastores in pages of a bounded size.
 func (b *Barrel) List() []string {
-	b.Lock()
-	defer b.Unlock()
+	snap := b.Snapshot()
+	defer snap.Release()
 
-	keys := make([]string, 0, len(b.keydir))
-
-	for k := range b.keydir {
-		keys = append(keys, k)
-	}
-
-	return keys
+	return snap.List()
 }
 
 // Len iterates over all keys and returns the total number of keys.
+// Expired keys which haven't been cleaned up yet are not counted.
 func (b *Barrel) Len() int {
-	b.Lock()
-	defer b.Unlock()
+	b.RLock()
+	defer b.RUnlock()
 
-	return len(b.keydir)
+	count := 0
+	b.keydir.Range(func(_ string, meta Meta) bool {
+		if !meta.isExpired() {
+			count++
+		}
+		return true
+	})
+
+	return count
 }
 
 // Fold iterates over all keys and calls the given function for each key.
+// Expired keys which haven't been cleaned up yet are skipped.
+// The keys are iterated over a snapshot, so writes made while iterating aren't
+// visible and fn can write to the datastore.
 func (b *Barrel) Fold(fn func(k string) error) error {
-	b.Lock()
-	defer b.Unlock()
+	snap := b.Snapshot()
+	defer snap.Release()
 
-	// Call fn for each key.
-	for k := range b.keydir {
-		if err := fn(k); err != nil {
-			return err
-		}
-	}
-	return nil
+	return snap.Fold(fn)
 }
 
 // Sync calls fsync(2) on the active data file.
 func (b *Barrel) Sync() error {
-	b.Lock()
-	defer b.Unlock()
+	b.RLock()
+	defer b.RUnlock()
 
 	return b.df.Sync()
 }
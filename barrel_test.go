@@ -1,12 +1,21 @@
 package barrel
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/mr-karan/barreldb/internal/datafile"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -40,6 +49,20 @@ func TestInitDefaults(t *testing.T) {
 		assert.Nil(brl.opts.syncInterval, "syncInterval is wrongly set")
 	})
 
+	t.Run("Locked", func(t *testing.T) {
+		// A partially written datafile header is only rewritten by the process holding the lock.
+		partial := filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 5))
+		assert.NoError(os.WriteFile(partial, []byte(datafile.Magic[:3]), 0644))
+		defer os.Remove(partial)
+
+		_, err := Init(WithDir(tmpDir))
+		assert.ErrorIs(err, ErrLocked)
+
+		data, err := os.ReadFile(partial)
+		assert.NoError(err)
+		assert.Equal(datafile.Magic[:3], string(data))
+	})
+
 	t.Run("Close", func(t *testing.T) {
 		err = brl.Shutdown()
 		assert.NoError(err)
@@ -133,6 +156,27 @@ func TestAPI(t *testing.T) {
 		_, err := brl.Get("keywithexpiry")
 		assert.Error(err)
 		assert.ErrorIs(err, ErrExpiredKey)
+
+		// Expired keys shouldn't be counted or listed.
+		assert.Equal(1, brl.Len())
+		assert.NotContains(brl.List(), "keywithexpiry")
+
+		// Cleanup should remove the expired key from the keydir.
+		assert.NoError(brl.cleanupExpired())
+		_, ok := brl.keydir.Get("keywithexpiry")
+		assert.False(ok)
+	})
+
+	t.Run("Expiry_Milliseconds", func(t *testing.T) {
+		err = brl.PutEx("shortlived", []byte("val"), time.Millisecond*200)
+		assert.NoError(err)
+
+		_, err := brl.Get("shortlived")
+		assert.NoError(err)
+
+		time.Sleep(time.Millisecond * 300)
+		_, err = brl.Get("shortlived")
+		assert.ErrorIs(err, ErrExpiredKey)
 	})
 
 	t.Run("Delete", func(t *testing.T) {
@@ -153,3 +197,2099 @@ func TestAPI(t *testing.T) {
 		assert.NoError(err)
 	})
 }
+
+// crash closes all the file handlers without generating the hints file,
+// simulating an abrupt shutdown of the process.
+func crash(brl *Barrel) error {
+	brl.Lock()
+	defer brl.Unlock()
+
+	if err := brl.df.Close(); err != nil {
+		return err
+	}
+	for _, df := range brl.stale {
+		if err := df.Close(); err != nil {
+			return err
+		}
+	}
+	return destroyFlockFile(brl.flockF)
+}
+
+func TestRecovery(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	t.Run("Without_Hints", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		assert.NoError(brl.Put("hello", []byte("world")))
+		assert.NoError(brl.Put("foo", []byte("bar")))
+		assert.NoError(brl.Put("foo", []byte("baz")))
+		assert.NoError(brl.Delete("hello"))
+		assert.NoError(brl.Put("empty", []byte{}))
+		assert.NoError(crash(brl))
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		val, err := brl.Get("foo")
+		assert.NoError(err)
+		assert.Equal("baz", string(val))
+
+		_, err = brl.Get("hello")
+		assert.ErrorIs(err, ErrNoKey)
+
+		// An empty value is not a tombstone.
+		val, err = brl.Get("empty")
+		assert.NoError(err)
+		assert.Empty(val)
+		assert.NoError(brl.Delete("empty"))
+		assert.Equal(1, brl.Len())
+	})
+
+	t.Run("With_Stale_Hints", func(t *testing.T) {
+		assert.NoError(brl.Shutdown())
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		// Write records after the hints file was generated.
+		assert.NoError(brl.Put("hello", []byte("again")))
+		assert.NoError(brl.Delete("foo"))
+		assert.NoError(crash(brl))
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		val, err := brl.Get("hello")
+		assert.NoError(err)
+		assert.Equal("again", string(val))
+
+		_, err = brl.Get("foo")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.Equal(1, brl.Len())
+	})
+
+	t.Run("Torn_Write", func(t *testing.T) {
+		assert.NoError(brl.Put("torn", []byte("record")))
+
+		// Append a partially written record at the end of the active file.
+		path := filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, brl.df.ID()))
+		size, err := brl.df.Size()
+		assert.NoError(err)
+		assert.NoError(crash(brl))
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(err)
+		_, err = f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02})
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		// The incomplete record should be discarded.
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(size, stat.Size())
+
+		val, err := brl.Get("torn")
+		assert.NoError(err)
+		assert.Equal("record", string(val))
+	})
+
+	t.Run("Torn_Value", func(t *testing.T) {
+		// Append a record whose header is complete but the value is only partially written.
+		record, err := brl.newRecord("torn-value", []byte("incomplete"), nil)
+		assert.NoError(err)
+		var buf bytes.Buffer
+		assert.NoError(record.encode(&buf, brl.df.Cipher()))
+
+		path := filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, brl.df.ID()))
+		size, err := brl.df.Size()
+		assert.NoError(err)
+		assert.NoError(crash(brl))
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(err)
+		_, err = f.Write(buf.Bytes()[:buf.Len()-4])
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(size, stat.Size())
+
+		_, err = brl.Get("torn-value")
+		assert.ErrorIs(err, ErrNoKey)
+		val, err := brl.Get("torn")
+		assert.NoError(err)
+		assert.Equal("record", string(val))
+	})
+
+	t.Run("Corrupted_Size", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			assert.NoError(brl.Put(fmt.Sprintf("size-%d", i), []byte("value")))
+		}
+
+		// Flip a bit in the value size of a record in the middle of the active file,
+		// so that the record seems to extend past the end of the file.
+		var (
+			meta, _ = brl.keydir.Get("size-4")
+			path    = filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, meta.FileID))
+			pos     = int64(meta.RecordPos - meta.RecordSize + headerSize(datafile.CurrentVersion) - 1)
+		)
+		size, err := brl.df.Size()
+		assert.NoError(err)
+		assert.NoError(crash(brl))
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		assert.NoError(err)
+		orig := make([]byte, 1)
+		_, err = f.ReadAt(orig, pos)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte{orig[0] ^ 0x80}, pos)
+		assert.NoError(err)
+
+		// The valid records after the corrupted one aren't discarded as a torn write.
+		_, err = Init(WithDir(tmpDir))
+		assert.ErrorIs(err, ErrChecksumMismatch)
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(size, stat.Size())
+
+		_, err = f.WriteAt(orig, pos)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		for i := 0; i < 10; i++ {
+			val, err := brl.Get(fmt.Sprintf("size-%d", i))
+			assert.NoError(err)
+			assert.Equal("value", string(val))
+		}
+	})
+
+	t.Run("Corrupted_Key", func(t *testing.T) {
+		assert.NoError(brl.Put("corrupt", []byte("me")))
+		assert.NoError(brl.Put("after", []byte("corruption")))
+
+		// Flip a bit in the key of the record.
+		var (
+			meta, _ = brl.keydir.Get("corrupt")
+			path    = filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, meta.FileID))
+		)
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte("C"), int64(meta.RecordPos-meta.RecordSize+headerSize(datafile.CurrentVersion)))
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		_, err = brl.Get("corrupt")
+		assert.ErrorIs(err, ErrChecksumMismatch)
+
+		// Replaying the corrupted datafile should fail.
+		assert.NoError(crash(brl))
+		_, err = Init(WithDir(tmpDir))
+		assert.ErrorIs(err, ErrChecksumMismatch)
+
+		// The lockfile is released, so the datastore isn't locked by the failed Init.
+		assert.NoFileExists(filepath.Join(tmpDir, LOCKFILE))
+		_, err = Init(WithDir(tmpDir))
+		assert.ErrorIs(err, ErrChecksumMismatch)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	// Write a datafile in the legacy format without a file header.
+	var buf bytes.Buffer
+	expiry := time.Now().Add(time.Hour).Unix()
+	for _, kv := range [][2]string{{"hello", "world"}, {"foo", "bar"}, {"deleted", ""}} {
+		header := [5]uint32{crc32.ChecksumIEEE([]byte(kv[1])), uint32(time.Now().Unix()), uint32(expiry), uint32(len(kv[0])), uint32(len(kv[1]))}
+		assert.NoError(binary.Write(&buf, binary.LittleEndian, header))
+		buf.WriteString(kv[0] + kv[1])
+	}
+	legacyPath := filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 0))
+	assert.NoError(os.WriteFile(legacyPath, buf.Bytes(), 0644))
+
+	t.Run("Read_Legacy", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		assert.Equal(datafile.VersionLegacy, brl.stale[0].Version())
+
+		val, err := brl.Get("hello")
+		assert.NoError(err)
+		assert.Equal("world", string(val))
+
+		// Expiry in seconds should be converted to milliseconds.
+		meta, _ := brl.keydir.Get("hello")
+		assert.Equal(int(expiry*1000), meta.Expiry)
+
+		// Empty values in legacy datafiles are tombstones.
+		_, err = brl.Get("deleted")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.NoError(brl.Shutdown())
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		n, err := Migrate(tmpDir)
+		assert.NoError(err)
+		assert.Equal(1, n)
+
+		data, err := os.ReadFile(legacyPath)
+		assert.NoError(err)
+		assert.True(bytes.HasPrefix(data, []byte(datafile.Magic)))
+
+		// Migrating again should be a no-op.
+		n, err = Migrate(tmpDir)
+		assert.NoError(err)
+		assert.Equal(0, n)
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		assert.Equal(datafile.CurrentVersion, brl.stale[0].Version())
+
+		val, err := brl.Get("foo")
+		assert.NoError(err)
+		assert.Equal("bar", string(val))
+		assert.NoError(brl.Shutdown())
+	})
+
+	t.Run("Unsupported_Version", func(t *testing.T) {
+		// Versions older than the file header can't be stored in one either.
+		for _, version := range []uint16{0, datafile.VersionLegacy, 0xffff} {
+			f, err := os.OpenFile(legacyPath, os.O_RDWR, 0644)
+			assert.NoError(err)
+			_, err = f.WriteAt([]byte{byte(version), byte(version >> 8)}, int64(len(datafile.Magic)))
+			assert.NoError(err)
+			assert.NoError(f.Close())
+
+			_, err = Init(WithDir(tmpDir))
+			assert.ErrorIs(err, ErrUnsupportedVersion, version)
+		}
+	})
+}
+
+func TestHints(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	t.Run("Rotate", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1))
+		assert.NoError(err)
+
+		assert.NoError(brl.Put("hello", []byte("world")))
+		assert.NoError(brl.Put("foo", []byte("bar")))
+		assert.NoError(brl.Delete("hello"))
+
+		// Rotating the active file should generate hints for the sealed file.
+		id := brl.df.ID()
+		assert.NoError(brl.rotateDF())
+		assert.FileExists(hintsPath(tmpDir, id))
+
+		var hints []hint
+		hdr, err := readHints(hintsPath(tmpDir, id), id, nil, func(h hint) error {
+			hints = append(hints, h)
+			return nil
+		})
+		assert.NoError(err)
+		assert.Len(hints, 2)
+		meta, _ := brl.keydir.Get("foo")
+		assert.Equal(meta, hints[1].Meta)
+		assert.True(hints[0].Tombstone)
+		assert.Equal(brl.stale[id].Header().Created, hdr.Created)
+
+		assert.NoError(brl.Put("after", []byte("rotate")))
+		assert.NoError(brl.Shutdown())
+		assert.FileExists(hintsPath(tmpDir, id+1))
+	})
+
+	t.Run("Load", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		_, err = brl.Get("hello")
+		assert.ErrorIs(err, ErrNoKey)
+
+		val, err := brl.Get("after")
+		assert.NoError(err)
+		assert.Equal("rotate", string(val))
+		assert.Equal(2, brl.Len())
+		assert.NoError(brl.Shutdown())
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		// A corrupted hints file should be rebuilt from the datafile.
+		files, err := filepath.Glob(filepath.Join(tmpDir, "*.hint"))
+		assert.NoError(err)
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			assert.NoError(err)
+			data[len(data)/2] ^= 0xff
+			assert.NoError(os.WriteFile(f, data, 0644))
+
+			_, err = readHints(f, 0, nil, func(h hint) error { return nil })
+			assert.ErrorIs(err, errInvalidHints)
+		}
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		val, err := brl.Get("foo")
+		assert.NoError(err)
+		assert.Equal("bar", string(val))
+		assert.Equal(2, brl.Len())
+
+		_, err = readHints(files[0], 0, nil, func(h hint) error { return nil })
+		assert.NoError(err)
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+// reverseCodec is a custom codec used for testing codec registration.
+type reverseCodec struct{}
+
+func (reverseCodec) ID() uint8    { return 15 }
+func (reverseCodec) Name() string { return "reverse" }
+func (reverseCodec) Compress(val []byte) ([]byte, error) {
+	out := make([]byte, 0, len(val)/2)
+	for i := len(val) - 1; i >= 0; i -= 2 {
+		out = append(out, val[i])
+	}
+	return out, nil
+}
+func (reverseCodec) Decompress(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data)*2)
+	for i := len(data) - 1; i >= 0; i-- {
+		out = append(out, data[i], data[i])
+	}
+	return out, nil
+}
+
+func TestCompression(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+		val    = []byte(strings.Repeat(`{"name":"barreldb"}`, 100))
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		assert.NoError(brl.Put("plain", val))
+		assert.NoError(brl.Shutdown())
+	})
+
+	for _, codec := range []Codec{CodecFlate, CodecGzip} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			brl, err = Init(WithDir(tmpDir), WithCompression(codec))
+			assert.NoError(err)
+
+			assert.NoError(brl.Put(codec.Name(), val))
+			meta, _ := brl.keydir.Get(codec.Name())
+			assert.Less(meta.RecordSize, len(val))
+
+			// Values written with any codec should be readable.
+			for _, k := range []string{"plain", "flate", codec.Name()} {
+				got, err := brl.Get(k)
+				assert.NoError(err)
+				assert.Equal(val, got)
+			}
+			assert.NoError(brl.Shutdown())
+		})
+	}
+
+	t.Run("Register", func(t *testing.T) {
+		assert.ErrorIs(RegisterCodec(CodecGzip), ErrInvalidCodec)
+		assert.NoError(RegisterCodec(reverseCodec{}))
+
+		c, ok := LookupCodec("reverse")
+		assert.True(ok)
+
+		brl, err = Init(WithDir(tmpDir), WithCompression(c))
+		assert.NoError(err)
+		assert.NoError(brl.Put("aabbcc", []byte("aabbcc")))
+
+		got, err := brl.Get("aabbcc")
+		assert.NoError(err)
+		assert.Equal("aabbcc", string(got))
+
+		got, err = brl.Get("gzip")
+		assert.NoError(err)
+		assert.Equal(val, got)
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+		oldKey = bytes.Repeat([]byte{1}, 32)
+		newKey = bytes.Repeat([]byte{2}, 32)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	t.Run("Invalid_Key", func(t *testing.T) {
+		_, err = Init(WithDir(tmpDir), WithEncryptionKey(1, []byte("short")))
+		assert.ErrorIs(err, ErrInvalidKey)
+	})
+
+	t.Run("Encrypt", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir), WithEncryptionKey(1, oldKey), WithMaxActiveFileSize(1))
+		assert.NoError(err)
+
+		assert.NoError(brl.Put("secret-key", []byte("secret-value")))
+		assert.NoError(brl.rotateDF())
+		assert.NoError(brl.Put("other-key", []byte("other-value")))
+		assert.NoError(brl.rotateDF())
+		assert.NoError(brl.Shutdown())
+
+		// Neither the datafiles nor the hints files should contain the keys or values in plaintext.
+		files, err := filepath.Glob(filepath.Join(tmpDir, "barrel_*"))
+		assert.NoError(err)
+		assert.NotEmpty(files)
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			assert.NoError(err)
+			assert.NotContains(string(data), "secret")
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir), WithEncryptionKey(1, oldKey))
+		assert.NoError(err)
+
+		val, err := brl.Get("secret-key")
+		assert.NoError(err)
+		assert.Equal("secret-value", string(val))
+		assert.NoError(brl.Shutdown())
+	})
+
+	t.Run("Missing_Key", func(t *testing.T) {
+		_, err = Init(WithDir(tmpDir))
+		assert.ErrorIs(err, ErrMissingKey)
+
+		_, err = Init(WithDir(tmpDir), WithEncryptionKey(2, newKey))
+		assert.ErrorIs(err, ErrMissingKey)
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		// Datafiles in the current format are skipped without needing the key.
+		n, err := Migrate(tmpDir)
+		assert.NoError(err)
+		assert.Equal(0, n)
+
+		// Write a datafile in the legacy format without a file header.
+		var (
+			buf    bytes.Buffer
+			header = [5]uint32{crc32.ChecksumIEEE([]byte("legacy-value")), uint32(time.Now().Unix()), 0, uint32(len("legacy-key")), uint32(len("legacy-value"))}
+		)
+		assert.NoError(binary.Write(&buf, binary.LittleEndian, header))
+		buf.WriteString("legacy-key" + "legacy-value")
+		legacyPath := filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 100))
+		assert.NoError(os.WriteFile(legacyPath, buf.Bytes(), 0644))
+
+		// The migrated datafile is encrypted with the given key.
+		n, err = Migrate(tmpDir, WithEncryptionKey(1, oldKey))
+		assert.NoError(err)
+		assert.Equal(1, n)
+
+		data, err := os.ReadFile(legacyPath)
+		assert.NoError(err)
+		assert.NotContains(string(data), "legacy-value")
+
+		brl, err = Init(WithDir(tmpDir), WithEncryptionKey(1, oldKey))
+		assert.NoError(err)
+		assert.Equal(uint32(1), brl.stale[100].Header().KeyID)
+
+		val, err := brl.Get("legacy-key")
+		assert.NoError(err)
+		assert.Equal("legacy-value", string(val))
+		assert.NoError(brl.Shutdown())
+	})
+
+	t.Run("Rotate_Key", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir), WithEncryptionKey(2, newKey), WithDecryptionKey(1, oldKey))
+		assert.NoError(err)
+
+		// Merging should re-encrypt the older datafiles with the new key.
+		assert.NoError(brl.merge())
+		assert.Len(brl.stale, 1)
+		for _, df := range brl.stale {
+			assert.Equal(uint32(2), df.Header().KeyID)
+		}
+		assert.NoError(brl.Shutdown())
+
+		brl, err = Init(WithDir(tmpDir), WithEncryptionKey(2, newKey))
+		assert.NoError(err)
+
+		for k, v := range map[string]string{"secret-key": "secret-value", "other-key": "other-value"} {
+			val, err := brl.Get(k)
+			assert.NoError(err)
+			assert.Equal(v, string(val))
+		}
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+func TestConcurrency(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0))
+	assert.NoError(err)
+	defer brl.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(brl.Put(fmt.Sprintf("key-%d", i), []byte("initial")))
+		assert.NoError(brl.rotateDF())
+	}
+
+	t.Run("Parallel_Reads", func(t *testing.T) {
+		// Reads shouldn't wait for other readers.
+		brl.RLock()
+		defer brl.RUnlock()
+
+		done := make(chan error)
+		go func() {
+			_, err := brl.Get("key-0")
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			assert.NoError(err)
+		case <-time.After(time.Second):
+			t.Fatal("read blocked by another reader")
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		var wg sync.WaitGroup
+
+		// Read and write concurrently while the stale files are merged.
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				assert.NoError(brl.Put("key-1", []byte(fmt.Sprintf("updated-%d", i))))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				val, err := brl.Get("key-0")
+				assert.NoError(err)
+				assert.Equal("initial", string(val))
+				assert.Equal(3, brl.Len())
+			}
+		}()
+
+		assert.NoError(brl.merge())
+		wg.Wait()
+
+		// All the datafiles, including the active one at the start, are replaced by the merged datafiles.
+		assert.NotEmpty(brl.stale)
+		for id := range brl.stale {
+			assert.Greater(id, 3)
+			assert.Less(id, brl.df.ID())
+		}
+
+		// The key overwritten during the merge should have the latest value.
+		val, err := brl.Get("key-1")
+		assert.NoError(err)
+		assert.Equal("updated-99", string(val))
+
+		val, err = brl.Get("key-2")
+		assert.NoError(err)
+		assert.Equal("initial", string(val))
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		// Shutdown waits for a running merge, which holds the merge lock.
+		brl.mergeMu.Lock()
+		done := make(chan error)
+		go func() {
+			done <- brl.Shutdown()
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("shutdown didn't wait for the merge")
+		case <-time.After(50 * time.Millisecond):
+		}
+		assert.FileExists(filepath.Join(tmpDir, LOCKFILE))
+
+		brl.mergeMu.Unlock()
+		assert.NoError(<-done)
+		assert.NoFileExists(filepath.Join(tmpDir, LOCKFILE))
+
+		// Nothing is merged or rotated once the datastore is shut down.
+		assert.ErrorIs(brl.merge(), ErrClosed)
+		_, err := brl.rotate(0)
+		assert.ErrorIs(err, ErrClosed)
+		assert.ErrorIs(brl.Shutdown(), ErrClosed)
+	})
+}
+
+func TestGroupCommit(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	t.Run("Parallel_Writes", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir), WithGroupCommit())
+		assert.NoError(err)
+		assert.True(brl.opts.alwaysFSync)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					assert.NoError(brl.Put(fmt.Sprintf("key-%d-%d", i, j), []byte("value")))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Sharing the fsync calls between the writers is tested in the datafile package.
+		assert.NoError(crash(brl))
+	})
+
+	t.Run("Recover", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		assert.Equal(400, brl.Len())
+
+		val, err := brl.Get("key-7-49")
+		assert.NoError(err)
+		assert.Equal("value", string(val))
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+func TestBatch(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	t.Run("Commit", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		assert.NoError(brl.Put("deleted", []byte("value")))
+
+		wb := brl.NewBatch()
+		assert.NoError(wb.Put("foo", []byte("bar")))
+		assert.NoError(wb.PutEx("expiry", []byte("value"), time.Hour))
+		assert.NoError(wb.Delete("deleted"))
+		assert.NoError(wb.Put("foo", []byte("baz")))
+		assert.Equal(4, wb.Len())
+
+		// Nothing should be visible before the batch is committed.
+		_, err = brl.Get("foo")
+		assert.ErrorIs(err, ErrNoKey)
+
+		assert.NoError(wb.Commit())
+		assert.Equal(0, wb.Len())
+
+		val, err := brl.Get("foo")
+		assert.NoError(err)
+		assert.Equal("baz", string(val))
+		_, err = brl.Get("deleted")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.Equal(2, brl.Len())
+		assert.NoError(crash(brl))
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		val, err := brl.Get("foo")
+		assert.NoError(err)
+		assert.Equal("baz", string(val))
+		_, err = brl.Get("deleted")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.Equal(2, brl.Len())
+		assert.NoError(crash(brl))
+	})
+
+	t.Run("Uncommitted", func(t *testing.T) {
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		assert.NoError(brl.Put("before", []byte("batch")))
+
+		size, err := brl.df.Size()
+		assert.NoError(err)
+
+		// Write the records of a batch without the commit record, as if the process crashed in between.
+		for _, k := range []string{"partial-1", "partial-2"} {
+			record, err := brl.newRecord(k, []byte("value"), nil)
+			assert.NoError(err)
+			record.Header.Flags |= flagBatch
+			_, _, err = brl.write(brl.df, record)
+			assert.NoError(err)
+		}
+		id := brl.df.ID()
+		assert.NoError(crash(brl))
+
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+
+		_, err = brl.Get("partial-1")
+		assert.ErrorIs(err, ErrNoKey)
+		val, err := brl.Get("before")
+		assert.NoError(err)
+		assert.Equal("batch", string(val))
+
+		// The uncommitted batch should be truncated.
+		newSize, err := brl.stale[id].Size()
+		assert.NoError(err)
+		assert.Equal(size, newSize)
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+func TestTxn(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir))
+	assert.NoError(err)
+	defer brl.Shutdown()
+
+	assert.NoError(brl.Put("balance", []byte("10")))
+
+	t.Run("Update", func(t *testing.T) {
+		err := brl.Update(func(tx *Txn) error {
+			val, err := tx.Get("balance")
+			if err != nil {
+				return err
+			}
+			assert.Equal("10", string(val))
+
+			if err := tx.Put("balance", []byte("20")); err != nil {
+				return err
+			}
+			if err := tx.Delete("missing"); err != nil {
+				return err
+			}
+
+			// Writes in the transaction should be visible to itself but not outside.
+			val, err = tx.Get("balance")
+			assert.NoError(err)
+			assert.Equal("20", string(val))
+
+			val, err = brl.Get("balance")
+			assert.NoError(err)
+			assert.Equal("10", string(val))
+			return nil
+		})
+		assert.NoError(err)
+
+		val, err := brl.Get("balance")
+		assert.NoError(err)
+		assert.Equal("20", string(val))
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		errAbort := fmt.Errorf("abort")
+		err := brl.Update(func(tx *Txn) error {
+			assert.NoError(tx.Put("balance", []byte("30")))
+			return errAbort
+		})
+		assert.ErrorIs(err, errAbort)
+
+		val, err := brl.Get("balance")
+		assert.NoError(err)
+		assert.Equal("20", string(val))
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		err := brl.Update(func(tx *Txn) error {
+			if _, err := tx.Get("balance"); err != nil {
+				return err
+			}
+			if _, err := tx.Get("created"); !errors.Is(err, ErrNoKey) {
+				return err
+			}
+
+			// Modify a key read by the transaction before it's committed.
+			assert.NoError(brl.Put("balance", []byte("40")))
+			return tx.Put("other", []byte("value"))
+		})
+		assert.ErrorIs(err, ErrConflict)
+
+		// None of the writes of the transaction should be applied.
+		_, err = brl.Get("other")
+		assert.ErrorIs(err, ErrNoKey)
+
+		// Creating a key which was read as missing should conflict as well.
+		err = brl.Update(func(tx *Txn) error {
+			if _, err := tx.Get("created"); !errors.Is(err, ErrNoKey) {
+				return err
+			}
+			assert.NoError(brl.Put("created", []byte("value")))
+			return nil
+		})
+		assert.ErrorIs(err, ErrConflict)
+	})
+
+	t.Run("View", func(t *testing.T) {
+		err := brl.View(func(tx *Txn) error {
+			val, err := tx.Get("balance")
+			assert.NoError(err)
+			assert.Equal("40", string(val))
+
+			return tx.Put("balance", []byte("50"))
+		})
+		assert.ErrorIs(err, ErrReadOnly)
+	})
+
+	t.Run("View_Consistent", func(t *testing.T) {
+		assert.NoError(brl.Put("from", []byte("100")))
+		assert.NoError(brl.Put("to", []byte("0")))
+
+		err := brl.View(func(tx *Txn) error {
+			val, err := tx.Get("from")
+			assert.NoError(err)
+			assert.Equal("100", string(val))
+
+			// A transfer committed after the transaction started isn't visible in it.
+			batch := brl.NewBatch()
+			assert.NoError(batch.Put("from", []byte("60")))
+			assert.NoError(batch.Put("to", []byte("40")))
+			assert.NoError(batch.Commit())
+
+			val, err = tx.Get("to")
+			assert.NoError(err)
+			assert.Equal("0", string(val))
+			return nil
+		})
+		assert.NoError(err)
+
+		val, err := brl.Get("to")
+		assert.NoError(err)
+		assert.Equal("40", string(val))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		assert.NoError(brl.Put("counter", []byte("0")))
+
+		// Increment the counter concurrently, retrying on conflicts.
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					for {
+						err := brl.Update(func(tx *Txn) error {
+							val, err := tx.Get("counter")
+							if err != nil {
+								return err
+							}
+							n, err := strconv.Atoi(string(val))
+							if err != nil {
+								return err
+							}
+							return tx.Put("counter", []byte(strconv.Itoa(n+1)))
+						})
+						if !errors.Is(err, ErrConflict) {
+							assert.NoError(err)
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		val, err := brl.Get("counter")
+		assert.NoError(err)
+		assert.Equal("80", string(val))
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1))
+	assert.NoError(err)
+	defer brl.Shutdown()
+
+	assert.NoError(brl.Put("foo", []byte("old")))
+	assert.NoError(brl.rotateDF())
+	assert.NoError(brl.Put("bar", []byte("old")))
+	assert.NoError(brl.rotateDF())
+
+	snap := brl.Snapshot()
+
+	t.Run("Isolation", func(t *testing.T) {
+		assert.NoError(brl.Put("foo", []byte("new")))
+		assert.NoError(brl.Delete("bar"))
+		assert.NoError(brl.Put("baz", []byte("new")))
+
+		val, err := snap.Get("foo")
+		assert.NoError(err)
+		assert.Equal("old", string(val))
+		val, err = snap.Get("bar")
+		assert.NoError(err)
+		assert.Equal("old", string(val))
+		_, err = snap.Get("baz")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.ElementsMatch([]string{"foo", "bar"}, snap.List())
+
+		val, err = brl.Get("foo")
+		assert.NoError(err)
+		assert.Equal("new", string(val))
+		assert.ElementsMatch([]string{"foo", "baz"}, brl.List())
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(brl.rotateDF())
+		assert.NoError(brl.merge())
+
+		// The merged datafiles should be kept open for the snapshot.
+		assert.NotEmpty(brl.retired)
+
+		val, err := snap.Get("foo")
+		assert.NoError(err)
+		assert.Equal("old", string(val))
+		val, err = snap.Get("bar")
+		assert.NoError(err)
+		assert.Equal("old", string(val))
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		assert.NoError(snap.Release())
+		assert.Empty(brl.retired)
+		assert.Empty(brl.pins)
+
+		_, err := snap.Get("foo")
+		assert.ErrorIs(err, ErrSnapshotReleased)
+	})
+
+	t.Run("Fold_Writes", func(t *testing.T) {
+		// Writes from within Fold shouldn't block or be visible to the iteration.
+		count := 0
+		err := brl.Fold(func(k string) error {
+			count++
+			return brl.Put(k+"-copy", []byte("value"))
+		})
+		assert.NoError(err)
+		assert.Equal(2, count)
+		assert.Equal(4, brl.Len())
+	})
+}
+
+func TestIterator(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1))
+	assert.NoError(err)
+	defer brl.Shutdown()
+
+	want := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		k, v := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		assert.NoError(brl.Put(k, []byte(v)))
+		want[k] = v
+		if i%10 == 0 {
+			assert.NoError(brl.rotateDF())
+		}
+	}
+	assert.NoError(brl.Delete("key-1"))
+	delete(want, "key-1")
+	assert.NoError(brl.PutEx("expired", []byte("value"), time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+
+	t.Run("Next", func(t *testing.T) {
+		it := brl.NewIterator()
+		got := make(map[string]string)
+		for it.Next() {
+			got[it.Key()] = string(it.Value())
+			meta, _ := brl.keydir.Get(it.Key())
+			assert.Equal(meta, it.Meta())
+		}
+		assert.NoError(it.Err())
+		assert.NoError(it.Close())
+		assert.Equal(want, got)
+		assert.Empty(brl.pins)
+	})
+
+	t.Run("Disk_Order", func(t *testing.T) {
+		it := brl.NewIterator(InDiskOrder())
+		defer it.Close()
+
+		var prev Meta
+		count := 0
+		for it.Next() {
+			meta := it.Meta()
+			assert.True(meta.FileID > prev.FileID || (meta.FileID == prev.FileID && meta.RecordPos > prev.RecordPos))
+			prev = meta
+			count++
+		}
+		assert.NoError(it.Err())
+		assert.Equal(len(want), count)
+	})
+
+	t.Run("FoldKV", func(t *testing.T) {
+		got := make(map[string]string)
+		err := brl.FoldKV(func(k string, v []byte) error {
+			got[k] = string(v)
+			return nil
+		}, InDiskOrder())
+		assert.NoError(err)
+		assert.Equal(want, got)
+
+		errStop := errors.New("stop")
+		err = brl.FoldKV(func(k string, v []byte) error {
+			return errStop
+		})
+		assert.ErrorIs(err, errStop)
+		assert.Empty(brl.pins)
+	})
+}
+
+func TestOrderedIndex(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir), WithOrderedIndex())
+	assert.NoError(err)
+
+	for _, k := range []string{"user:2:name", "user:1:name", "user:10:name", "user:1:email", "post:1", "users"} {
+		assert.NoError(brl.Put(k, []byte("value-"+k)))
+	}
+	assert.NoError(brl.PutEx("user:3:name", []byte("value"), time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+
+	keys := func(it *Iterator) []string {
+		defer it.Close()
+		keys := []string{}
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		assert.NoError(it.Err())
+		return keys
+	}
+
+	t.Run("Scan", func(t *testing.T) {
+		assert.Equal([]string{"user:10:name", "user:1:email", "user:1:name", "user:2:name"}, keys(brl.Scan("user:")))
+		assert.Equal([]string{"user:1:email", "user:1:name"}, keys(brl.Scan("user:1:")))
+		assert.Equal([]string{"post:1", "user:10:name", "user:1:email", "user:1:name", "user:2:name", "users"}, keys(brl.Scan("")))
+		assert.Empty(keys(brl.Scan("none")))
+
+		it := brl.Scan("post:")
+		assert.True(it.Next())
+		assert.Equal([]byte("value-post:1"), it.Value())
+		assert.NoError(it.Close())
+
+		it = brl.Scan("post:", KeysOnly())
+		assert.True(it.Next())
+		assert.Nil(it.Value())
+		assert.NoError(it.Close())
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		assert.Equal([]string{"user:1:name"}, keys(brl.Range("user:1:name", "user:2")))
+		assert.Equal([]string{"user:2:name", "users"}, keys(brl.Range("user:2", "")))
+		assert.Empty(keys(brl.Range("x", "")))
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		assert.Equal([]string{"user:2:name", "user:1:name", "user:1:email", "user:10:name"}, keys(brl.Scan("user:", Reverse())))
+		assert.Equal([]string{"user:1:email", "user:10:name"}, keys(brl.Range("user:", "user:1:name", Reverse())))
+		assert.Equal([]string{"users", "user:2:name"}, keys(brl.Range("user:2", "", Reverse())))
+		assert.Equal([]string{"users", "user:2:name", "user:1:name", "user:1:email", "user:10:name", "post:1"}, keys(brl.NewIterator(Reverse())))
+	})
+
+	t.Run("Disk_Order", func(t *testing.T) {
+		// The keys in the range are visited in the order they were written.
+		assert.Equal([]string{"user:2:name", "user:1:name", "user:10:name", "user:1:email"}, keys(brl.Scan("user:", InDiskOrder())))
+		assert.Equal([]string{"user:1:name", "user:1:email"}, keys(brl.Range("user:1:", "user:2", InDiskOrder())))
+		assert.Empty(keys(brl.Range("x", "", InDiskOrder())))
+
+		it := brl.Scan("user:", InDiskOrder(), Reverse())
+		assert.False(it.Next())
+		assert.ErrorIs(it.Err(), ErrReverseDiskOrder)
+		assert.NoError(it.Close())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.NoError(brl.Delete("user:1:email"))
+		assert.Equal([]string{"user:1:name"}, keys(brl.Scan("user:1:")))
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		snap := brl.Snapshot()
+		defer snap.Release()
+
+		assert.NoError(brl.Put("user:1:age", []byte("30")))
+		assert.NoError(brl.Delete("user:1:name"))
+
+		it := snap.NewIterator(withRange("user:1:", "user:1;"))
+		assert.Equal([]string{"user:1:name"}, keys(it))
+		assert.Equal([]string{"user:1:age"}, keys(brl.Scan("user:1:")))
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		assert.NoError(brl.Shutdown())
+		brl, err = Init(WithDir(tmpDir), WithOrderedIndex())
+		assert.NoError(err)
+		defer brl.Shutdown()
+
+		assert.Equal([]string{"user:10:name", "user:1:age", "user:2:name"}, keys(brl.Scan("user:")))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "barreldb")
+		assert.NoError(err)
+		defer os.RemoveAll(dir)
+
+		brl, err := Init(WithDir(dir))
+		assert.NoError(err)
+		defer brl.Shutdown()
+
+		it := brl.Scan("user:")
+		assert.False(it.Next())
+		assert.ErrorIs(it.Err(), ErrNoIndex)
+		assert.NoError(it.Close())
+
+		it = brl.NewIterator(Reverse())
+		assert.False(it.Next())
+		assert.ErrorIs(it.Err(), ErrNoIndex)
+		assert.NoError(it.Close())
+
+		// A range visited in disk order doesn't need the ordered index.
+		assert.NoError(brl.Put("user:1", []byte("value")))
+		assert.NoError(brl.Put("post:1", []byte("value")))
+		assert.Equal([]string{"user:1"}, keys(brl.Scan("user:", InDiskOrder())))
+	})
+}
+
+func TestListPage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  []Config
+	}{
+		{"Shards", []Config{WithShards(4)}},
+		{"Ordered_Index", []Config{WithOrderedIndex()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			// Create a temp directory for running tests.
+			tmpDir, err := os.MkdirTemp("", "barreldb")
+			defer os.RemoveAll(tmpDir)
+
+			assert.NoError(err)
+
+			brl, err := Init(append(tc.cfg, WithDir(tmpDir))...)
+			assert.NoError(err)
+			defer brl.Shutdown()
+
+			want := []string{}
+			for i := 0; i < 100; i++ {
+				k := fmt.Sprintf("key-%d", i)
+				assert.NoError(brl.Put(k, []byte("value")))
+				want = append(want, k)
+			}
+			assert.NoError(brl.Put("other", []byte("value")))
+			assert.NoError(brl.PutEx("key-expired", []byte("value"), time.Millisecond))
+			time.Sleep(2 * time.Millisecond)
+
+			// list returns all the keys of a listing along with the number of pages.
+			list := func(count int, pattern string, each func()) ([]string, int) {
+				var (
+					keys  = []string{}
+					cur   = ""
+					pages = 0
+				)
+				for {
+					page, next, err := brl.ListPage(cur, count, pattern)
+					assert.NoError(err)
+					assert.LessOrEqual(len(page), count)
+					keys = append(keys, page...)
+					pages++
+					if next == "" {
+						return keys, pages
+					}
+					cur = next
+					each()
+				}
+			}
+
+			t.Run("Pages", func(t *testing.T) {
+				keys, pages := list(7, "key-*", func() {})
+				assert.ElementsMatch(want, keys)
+				assert.Greater(pages, 1)
+
+				keys, _ = list(1000, "", func() {})
+				assert.ElementsMatch(append(want, "other"), keys)
+
+				keys, _ = list(3, "key-1?", func() {})
+				assert.ElementsMatch([]string{"key-10", "key-11", "key-12", "key-13", "key-14", "key-15", "key-16", "key-17", "key-18", "key-19"}, keys)
+			})
+
+			t.Run("Concurrent_Writes", func(t *testing.T) {
+				i := 0
+				keys, _ := list(5, "key-*", func() {
+					// Keys which are added or deleted during the listing may or may not be
+					// returned, but the keys which exist for the whole listing are returned once.
+					assert.NoError(brl.Put(fmt.Sprintf("key-new-%d", i), []byte("value")))
+					assert.NoError(brl.Put(fmt.Sprintf("key-%d", i), []byte("updated")))
+					i++
+				})
+
+				seen := make(map[string]int)
+				for _, k := range keys {
+					seen[k]++
+				}
+				for _, k := range want {
+					assert.Equal(1, seen[k], k)
+				}
+			})
+
+			t.Run("Invalid_Cursor", func(t *testing.T) {
+				_, _, err := brl.ListPage("invalid cursor", 10, "")
+				assert.ErrorIs(err, ErrInvalidCursor)
+
+				// Cursors over the shards depend on the hash seed of the keydir, so they
+				// aren't accepted by another instance.
+				other, err := Init(append(tc.cfg, WithDir(t.TempDir()), WithReadOnly())...)
+				assert.NoError(err)
+				defer other.Shutdown()
+
+				_, next, err := brl.ListPage("", 10, "")
+				assert.NoError(err)
+				_, _, err = other.ListPage(next, 10, "")
+				if tc.name == "Shards" {
+					assert.ErrorIs(err, ErrInvalidCursor)
+				} else {
+					assert.NoError(err)
+				}
+			})
+		})
+	}
+}
+
+func TestPatternPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("key-", PatternPrefix("key-*"))
+	assert.Equal("key-", PatternPrefix("key-?"))
+	assert.Equal("key-", PatternPrefix("key-[0-9]"))
+	assert.Equal("key", PatternPrefix(`key\*`))
+	assert.Equal("key", PatternPrefix("key"))
+	assert.Equal("", PatternPrefix("*"))
+}
+
+func TestMerge(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithCompression(CodecGzip), WithMergeThreshold(0))
+	assert.NoError(err)
+
+	want := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		k, v := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		assert.NoError(brl.Put(k, []byte(v)))
+		want[k] = v
+		if i%10 == 9 {
+			assert.NoError(brl.rotateDF())
+		}
+	}
+	for i := 0; i < 5; i++ {
+		k, v := fmt.Sprintf("key-%d", i), fmt.Sprintf("updated-%d", i)
+		assert.NoError(brl.Put(k, []byte(v)))
+	}
+	ttl := strings.Repeat("compressible ", 100)
+	assert.NoError(brl.PutEx("ttl", []byte(ttl), time.Hour))
+	assert.NoError(brl.PutEx("expired", []byte("value"), time.Millisecond))
+	assert.NoError(brl.Delete("key-29"))
+	assert.NoError(brl.rotateDF())
+	for i := 0; i < 5; i++ {
+		want[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("updated-%d", i)
+	}
+	delete(want, "key-29")
+	want["ttl"] = ttl
+
+	// Writes to the active datafile aren't merged.
+	assert.NoError(brl.Put("active", []byte("value")))
+	want["active"] = "value"
+	time.Sleep(2 * time.Millisecond)
+
+	before := make(map[string]Record)
+	for k := range want {
+		record, err := brl.get(k)
+		assert.NoError(err)
+		before[k] = record
+	}
+
+	check := func() {
+		for k, v := range want {
+			val, err := brl.Get(k)
+			assert.NoError(err, k)
+			assert.Equal(v, string(val))
+		}
+		_, err := brl.Get("key-29")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.ElementsMatch(keys(want), brl.List())
+	}
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.Len(brl.stale, 4)
+		assert.NoError(brl.merge())
+
+		// The max size of a datafile is 1 byte, so every live record is merged into its own datafile.
+		assert.Len(brl.stale, len(want))
+
+		files, err := getDataFiles(tmpDir)
+		assert.NoError(err)
+		assert.Len(files, len(want)+1)
+
+		check()
+		_, ok := brl.keydir.Get("expired")
+		assert.False(ok)
+
+		// The active datafile is merged as well and the merged datafile
+		// is older than the datafile which is now active.
+		meta, _ := brl.keydir.Get("active")
+		assert.Less(meta.FileID, brl.df.ID())
+		assert.Contains(brl.stale, meta.FileID)
+		assert.NoDirExists(filepath.Join(tmpDir, MERGE_DIR))
+	})
+
+	t.Run("Preserve_Header", func(t *testing.T) {
+		for k, old := range before {
+			record, err := brl.get(k)
+			assert.NoError(err)
+			assert.Equal(old.Header.Timestamp, record.Header.Timestamp, k)
+			assert.Equal(old.Header.Expiry, record.Header.Expiry, k)
+			assert.Equal(old.Header.Flags, record.Header.Flags, k)
+			assert.Equal(old.Value, record.Value, k)
+		}
+
+		record, err := brl.get("ttl")
+		assert.NoError(err)
+		assert.NotZero(record.Header.Expiry)
+		assert.Equal(CodecGzip.ID(), record.Header.codec())
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		// The TTL leaves enough time for merging every record into its own datafile.
+		expiry := time.Now().Add(500 * time.Millisecond)
+		assert.NoError(brl.PutEx("short-ttl", []byte("value"), time.Until(expiry)))
+		assert.NoError(brl.rotateDF())
+		assert.NoError(brl.merge())
+		assert.Len(brl.stale, len(want)+1)
+
+		val, err := brl.Get("short-ttl")
+		assert.NoError(err)
+		assert.Equal("value", string(val))
+
+		time.Sleep(time.Until(expiry) + 10*time.Millisecond)
+		_, err = brl.Get("short-ttl")
+		assert.ErrorIs(err, ErrExpiredKey)
+	})
+
+	t.Run("Nothing_To_Merge", func(t *testing.T) {
+		// The merged datafile doesn't have enough garbage to be merged again.
+		brl.opts.mergeThreshold = 1
+		defer func() { brl.opts.mergeThreshold = 0 }()
+
+		stale := make(map[int]*datafile.DataFile, len(brl.stale))
+		for id, df := range brl.stale {
+			stale[id] = df
+		}
+		assert.NoError(brl.merge())
+		assert.Equal(stale, brl.stale)
+	})
+
+	t.Run("Crash", func(t *testing.T) {
+		// stage copies the live records of the stale datafiles to staged merged datafiles.
+		stage := func() mergeOutput {
+			out, err := brl.stageMerge()
+			assert.NoError(err)
+			assert.NotEmpty(out.dfs)
+
+			// Writes made during the merge go to the active datafile, which is newer.
+			assert.NoError(brl.Put("key-1", []byte("written-during-merge")))
+			want["key-1"] = "written-during-merge"
+			delete(before, "key-1")
+			return out
+		}
+
+		// The merge is interrupted before the merged datafile is published.
+		assert.NoError(brl.Put("key-0", []byte("before-crash")))
+		want["key-0"] = "before-crash"
+		delete(before, "key-0")
+		out := stage()
+		for _, df := range out.dfs {
+			assert.NoError(df.Close())
+		}
+		assert.NoError(brl.Shutdown())
+		assert.DirExists(filepath.Join(tmpDir, MERGE_DIR))
+
+		brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0))
+		assert.NoError(err)
+		check()
+		assert.NoDirExists(filepath.Join(tmpDir, MERGE_DIR))
+
+		// The merge is interrupted after the merged datafile is published
+		// but before the merged datafiles are removed.
+		out = stage()
+		for _, df := range out.dfs {
+			name := fmt.Sprintf(datafile.ACTIVE_DATAFILE, df.ID())
+			assert.NoError(os.Rename(filepath.Join(tmpDir, MERGE_DIR, name), filepath.Join(tmpDir, name)))
+			assert.NoError(df.Close())
+		}
+		assert.NoError(brl.Shutdown())
+
+		brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0))
+		assert.NoError(err)
+		check()
+
+		assert.NoError(brl.merge())
+		assert.Len(brl.stale, len(want))
+		check()
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		assert.NoError(brl.Shutdown())
+
+		// The values stay readable once the datastore isn't configured with the codec anymore.
+		brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0))
+		assert.NoError(err)
+
+		check()
+		for k, old := range before {
+			meta, ok := brl.keydir.Get(k)
+			assert.True(ok)
+			assert.Equal(int(old.Header.Timestamp), meta.Timestamp, k)
+			assert.Equal(int(old.Header.Expiry), meta.Expiry, k)
+		}
+
+		assert.NoError(brl.rotateDF())
+		assert.NoError(brl.merge())
+		check()
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+// keys returns the keys of the map.
+func keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestMergeThreshold(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	_, err = Init(WithDir(tmpDir), WithMergeThreshold(1.5))
+	assert.Error(err)
+
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0.5))
+	assert.NoError(err)
+
+	put := func(prefix string, n int, val string) {
+		for i := 0; i < n; i++ {
+			assert.NoError(brl.Put(fmt.Sprintf("%s-%d", prefix, i), []byte(val)))
+		}
+	}
+
+	// The live bytes of every datafile should match the records the keydir points to.
+	checkStats := func() {
+		live := make(map[int]int64)
+		brl.keydir.Range(func(_ string, meta Meta) bool {
+			live[meta.FileID] += int64(meta.RecordSize)
+			return true
+		})
+		for id := range brl.stale {
+			assert.Equal(live[id], brl.keydir.stats.get(id), id)
+		}
+		assert.Equal(live[brl.df.ID()], brl.keydir.stats.get(brl.df.ID()))
+	}
+
+	put("a", 10, "static")
+	assert.NoError(brl.rotateDF())
+	put("b", 10, "old")
+	assert.NoError(brl.rotateDF())
+	put("b", 8, "new")
+	assert.NoError(brl.Delete("a-0"))
+	assert.NoError(brl.rotateDF())
+
+	var (
+		a = brl.stale[0]
+		b = brl.stale[1]
+		c = brl.stale[2]
+	)
+
+	t.Run("Stats", func(t *testing.T) {
+		checkStats()
+
+		// a-0 was deleted, so 9 of the 10 records of the same size in the first datafile are live.
+		size, err := a.Size()
+		assert.NoError(err)
+		assert.Equal(size-int64(a.Start()), brl.keydir.stats.get(a.ID())/9*10)
+
+		// 8 of the 10 records in the second datafile were overwritten in the third one.
+		assert.Less(brl.keydir.stats.get(b.ID()), brl.keydir.stats.get(c.ID()))
+	})
+
+	t.Run("Merge_Garbage", func(t *testing.T) {
+		// Only the datafile with most of the keys overwritten is merged.
+		assert.NoError(brl.merge())
+		assert.Equal(a, brl.stale[a.ID()])
+		assert.Equal(c, brl.stale[c.ID()])
+		assert.NotContains(brl.stale, b.ID())
+		assert.Len(brl.stale, 4) // The 2 live records of b are merged into their own datafiles.
+		assert.NoFileExists(filepath.Join(tmpDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, b.ID())))
+		checkStats()
+
+		for i := 0; i < 10; i++ {
+			val, err := brl.Get(fmt.Sprintf("b-%d", i))
+			assert.NoError(err)
+			if i < 8 {
+				assert.Equal("new", string(val))
+			} else {
+				assert.Equal("old", string(val))
+			}
+		}
+
+		// Nothing is merged once the garbage is reclaimed.
+		stale := len(brl.stale)
+		id := brl.df.ID()
+		assert.NoError(brl.merge())
+		assert.Len(brl.stale, stale)
+		assert.Equal(id, brl.df.ID())
+	})
+
+	t.Run("Keep_Tombstones", func(t *testing.T) {
+		// The datafile with the tombstone of a-0 is merged, while the older datafile
+		// with the record of a-0 isn't. The tombstone must be kept in the merged datafile.
+		put("b", 8, "newer")
+		assert.NoError(brl.PutEx("a-1", []byte("expiring"), time.Millisecond))
+		assert.NoError(brl.rotateDF())
+		time.Sleep(2 * time.Millisecond)
+
+		assert.NoError(brl.merge())
+		assert.Equal(a, brl.stale[a.ID()])
+		assert.NotContains(brl.stale, c.ID())
+
+		assert.NoError(brl.Shutdown())
+		brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0.5))
+		assert.NoError(err)
+		checkStats()
+
+		_, err = brl.Get("a-0")
+		assert.ErrorIs(err, ErrNoKey)
+		_, err = brl.Get("a-1")
+		assert.ErrorIs(err, ErrNoKey)
+		val, err := brl.Get("a-2")
+		assert.NoError(err)
+		assert.Equal("static", string(val))
+		val, err = brl.Get("b-0")
+		assert.NoError(err)
+		assert.Equal("newer", string(val))
+	})
+
+	t.Run("Drop_Tombstones", func(t *testing.T) {
+		// Once all the datafiles are merged, no tombstones are needed.
+		brl.opts.mergeThreshold = 0
+		assert.NoError(brl.merge())
+		assert.Len(brl.stale, 18)
+		for _, df := range brl.stale {
+			res := brl.loadHints(df)
+			assert.NoError(res.err)
+			for _, h := range res.hints {
+				assert.False(h.Tombstone, h.Key)
+			}
+		}
+		assert.Equal(18, brl.Len())
+		assert.NoError(brl.Shutdown())
+	})
+}
+
+func TestMergeTombstones(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	// The tombstones kept by the merge fit in a single datafile.
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(256), WithMergeThreshold(0.5))
+	assert.NoError(err)
+	defer brl.Shutdown()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(brl.Put(fmt.Sprintf("a-%d", i), []byte("static")))
+	}
+	assert.NoError(brl.rotateDF())
+	old := brl.stale[0]
+
+	// Delete a few keys of the older datafile and overwrite a key in the newer one,
+	// so that only the newer datafile is merged and its tombstones are kept.
+	for i := 0; i < 4; i++ {
+		assert.NoError(brl.Delete(fmt.Sprintf("a-%d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(brl.Put("b", []byte(strconv.Itoa(i))))
+	}
+	assert.NoError(brl.rotateDF())
+	assert.NoError(brl.merge())
+	assert.Equal(old, brl.stale[0])
+
+	// tombstones returns the ID of the datafile with the tombstones kept by the merge.
+	tombstones := func() int {
+		for id := range brl.stale {
+			if brl.keydir.stats.getTombstones(id) > 0 {
+				return id
+			}
+		}
+		return -1
+	}
+	merged := tombstones()
+	assert.Greater(merged, old.ID())
+
+	// The tombstones are needed while the older datafile exists, so they aren't garbage.
+	assert.NotContains(brl.mergeCandidates(), merged)
+
+	// Once the older datafile is merged, the tombstones are garbage.
+	for i := 4; i < 10; i++ {
+		assert.NoError(brl.Put(fmt.Sprintf("a-%d", i), []byte("updated-value")))
+	}
+	assert.NoError(brl.rotateDF())
+	assert.NoError(brl.merge())
+	assert.NotContains(brl.stale, old.ID())
+	assert.Contains(brl.mergeCandidates(), merged)
+
+	// Merging the datafile drops the tombstones.
+	assert.NoError(brl.merge())
+	assert.NotContains(brl.stale, merged)
+	assert.Equal(-1, tombstones())
+
+	for i := 0; i < 10; i++ {
+		val, err := brl.Get(fmt.Sprintf("a-%d", i))
+		if i < 4 {
+			assert.ErrorIs(err, ErrNoKey)
+			continue
+		}
+		assert.NoError(err)
+		assert.Equal("updated-value", string(val))
+	}
+}
+
+func TestMergeReserve(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	const maxSize = 8192
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(maxSize), WithMergeThreshold(0.5))
+	assert.NoError(err)
+	defer brl.Shutdown()
+
+	for i := 0; i < 5000; i++ {
+		assert.NoError(brl.Put(fmt.Sprintf("key-%d", i), []byte("value")))
+	}
+	assert.NoError(brl.rotateDF())
+	old := brl.stale[0]
+
+	// The datafile with the deletes is merged, but not the older datafile, so all the
+	// tombstones are kept even though there isn't any live record.
+	for i := 0; i < 2000; i++ {
+		assert.NoError(brl.Delete(fmt.Sprintf("key-%d", i)))
+	}
+	assert.NoError(brl.rotateDF())
+
+	t.Run("Tombstones", func(t *testing.T) {
+		assert.NoError(brl.merge())
+		assert.Equal(old, brl.stale[0])
+		assert.Greater(len(brl.stale), 2)
+
+		for id, df := range brl.stale {
+			if id == old.ID() {
+				continue
+			}
+			size, err := df.Size()
+			assert.NoError(err)
+			assert.LessOrEqual(size, int64(maxSize))
+		}
+
+		_, err := brl.Get("key-0")
+		assert.ErrorIs(err, ErrNoKey)
+		assert.Len(brl.List(), 3000)
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		// The merge fails instead of overfilling the last reserved datafile.
+		brl.opts.mergeThreshold = 0
+		defer func() { brl.opts.mergeThreshold = 0.5 }()
+
+		id, err := brl.rotate(1)
+		assert.NoError(err)
+
+		brl.RLock()
+		in := brl.mergeInput(id)
+		brl.RUnlock()
+
+		_, err = brl.copyLive(id, 1, in)
+		assert.Error(err)
+		assert.NoDirExists(filepath.Join(tmpDir, MERGE_DIR))
+
+		// The merge succeeds with the reserve computed for the datafiles.
+		assert.NoError(brl.merge())
+		assert.Len(brl.List(), 3000)
+	})
+}
+
+func TestMergeConcurrentWrites(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(1), WithMergeThreshold(0))
+	assert.NoError(err)
+
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		k, v := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		assert.NoError(brl.Put(k, []byte(v)))
+		want[k] = v
+	}
+	assert.NoError(brl.PutEx("expired", []byte("value"), time.Millisecond))
+	assert.NoError(brl.rotateDF())
+	time.Sleep(2 * time.Millisecond)
+
+	check := func() {
+		for k, v := range want {
+			val, err := brl.Get(k)
+			assert.NoError(err, k)
+			assert.Equal(v, string(val))
+		}
+		assert.ElementsMatch(keys(want), brl.List())
+	}
+
+	t.Run("Swap", func(t *testing.T) {
+		out, err := brl.stageMerge()
+		assert.NoError(err)
+		assert.NotEmpty(out.dfs)
+		first, last := out.dfs[0].ID(), out.dfs[len(out.dfs)-1].ID()
+
+		// Reads, writes and rotations aren't blocked while the records are copied.
+		assert.NoError(brl.Put("key-0", []byte("overwritten")))
+		assert.NoError(brl.Delete("key-1"))
+		assert.NoError(brl.Put("expired", []byte("written-again")))
+		assert.NoError(brl.rotateDF())
+		want["key-0"] = "overwritten"
+		want["expired"] = "written-again"
+		delete(want, "key-1")
+		check()
+
+		assert.NoError(brl.replaceMerged(out))
+		check()
+
+		// The keys written during the merge point to the newer datafiles.
+		for _, k := range []string{"key-0", "expired"} {
+			meta, ok := brl.keydir.Get(k)
+			assert.True(ok)
+			assert.Greater(meta.FileID, last)
+		}
+		meta, ok := brl.keydir.Get("key-2")
+		assert.True(ok)
+		assert.GreaterOrEqual(meta.FileID, first)
+		assert.LessOrEqual(meta.FileID, last)
+	})
+
+	t.Run("Parallel", func(t *testing.T) {
+		var (
+			wg   sync.WaitGroup
+			done = make(chan struct{})
+		)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				assert.NoError(brl.Put(fmt.Sprintf("key-%d", i%50), []byte(fmt.Sprintf("parallel-%d", i))))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				val, err := brl.Get("key-99")
+				assert.NoError(err)
+				assert.Equal("value-99", string(val))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.NoError(brl.rotateDF())
+			}
+		}()
+
+		for i := 0; i < 5; i++ {
+			assert.NoError(brl.merge())
+		}
+		close(done)
+		wg.Wait()
+
+		for i := 150; i < 200; i++ {
+			want[fmt.Sprintf("key-%d", i%50)] = fmt.Sprintf("parallel-%d", i)
+		}
+		check()
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		assert.NoError(brl.Shutdown())
+		brl, err = Init(WithDir(tmpDir))
+		assert.NoError(err)
+		defer brl.Shutdown()
+
+		check()
+	})
+}
+
+func TestMergeSplit(t *testing.T) {
+	var (
+		brl    = &Barrel{}
+		assert = assert.New(t)
+	)
+
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(err)
+
+	const maxSize = 512
+	brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(maxSize), WithMergeThreshold(0))
+	assert.NoError(err)
+
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		k, v := fmt.Sprintf("key-%d", i), strings.Repeat(fmt.Sprint(i%10), 32)
+		assert.NoError(brl.Put(k, []byte(v)))
+		want[k] = v
+	}
+	assert.NoError(brl.rotateDF())
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		assert.NoError(brl.Put(k, []byte("updated")))
+		want[k] = "updated"
+	}
+	assert.NoError(brl.rotateDF())
+
+	check := func() {
+		for k, v := range want {
+			val, err := brl.Get(k)
+			assert.NoError(err, k)
+			assert.Equal(v, string(val))
+		}
+	}
+
+	t.Run("Merge", func(t *testing.T) {
+		old := make([]int, 0, len(brl.stale))
+		for id := range brl.stale {
+			old = append(old, id)
+		}
+		sort.Ints(old)
+
+		assert.NoError(brl.merge())
+		check()
+
+		ids := make([]int, 0, len(brl.stale))
+		for id := range brl.stale {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		assert.Greater(len(ids), 1)
+
+		for i, id := range ids {
+			// The merged datafiles get consecutive IDs which are newer than the datafiles
+			// which were merged and older than the active datafile.
+			assert.Equal(ids[0]+i, id)
+			assert.Greater(id, old[len(old)-1])
+			assert.Less(id, brl.df.ID())
+
+			size, err := brl.stale[id].Size()
+			assert.NoError(err)
+			assert.LessOrEqual(size, int64(maxSize))
+			assert.FileExists(hintsPath(tmpDir, id))
+		}
+	})
+
+	t.Run("Active", func(t *testing.T) {
+		// Writes after the merge go to the active datafile, which isn't one of the merged datafiles.
+		assert.NoError(brl.Put("key-0", []byte("active")))
+		want["key-0"] = "active"
+
+		meta, ok := brl.keydir.Get("key-0")
+		assert.True(ok)
+		assert.Equal(brl.df.ID(), meta.FileID)
+		assert.NotContains(brl.stale, brl.df.ID())
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		active := brl.df.ID()
+		assert.NoError(brl.Shutdown())
+
+		brl, err = Init(WithDir(tmpDir), WithMaxActiveFileSize(maxSize), WithMergeThreshold(0))
+		assert.NoError(err)
+		defer brl.Shutdown()
+
+		check()
+		assert.Greater(brl.df.ID(), active)
+	})
+}
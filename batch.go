@@ -0,0 +1,170 @@
+package barrel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Batch is a set of writes which are applied atomically.
+// Either all of the writes in the batch are applied or none of them are,
+// even if the process crashes while the batch is being committed.
+// A batch is not safe for concurrent use.
+type Batch struct {
+	barrel  *Barrel
+	records []Record
+}
+
+// NewBatch creates an empty batch of writes.
+func (b *Barrel) NewBatch() *Batch {
+	return &Batch{barrel: b}
+}
+
+// Put adds a write for the key and value to the batch.
+func (wb *Batch) Put(k string, val []byte) error {
+	return wb.put(k, val, nil)
+}
+
+// PutEx is same as Put but also takes an additional expiry time.
+func (wb *Batch) PutEx(k string, val []byte, ex time.Duration) error {
+	// Add the expiry to the current time.
+	expiry := time.Now().Add(ex)
+	return wb.put(k, val, &expiry)
+}
+
+func (wb *Batch) put(k string, val []byte, expiry *time.Time) error {
+	// Validate key and value.
+	if err := validateKV(k, val); err != nil {
+		return err
+	}
+
+	record, err := wb.barrel.newRecord(k, val, expiry)
+	if err != nil {
+		return err
+	}
+
+	wb.records = append(wb.records, record)
+	return nil
+}
+
+// Delete adds a delete for the key to the batch.
+func (wb *Batch) Delete(k string) error {
+	wb.records = append(wb.records, Record{
+		Header: Header{
+			Timestamp: time.Now().UnixMilli(),
+			Flags:     flagTombstone,
+			KeySize:   uint32(len(k)),
+		},
+		Key: k,
+	})
+	return nil
+}
+
+// Len returns the number of writes in the batch.
+func (wb *Batch) Len() int {
+	return len(wb.records)
+}
+
+// Commit writes all the records in the batch to the active datafile followed by a
+// commit record. The records of a batch are ignored while loading the datafile if
+// the commit record is missing. The batch is reset once it's committed.
+func (wb *Batch) Commit() error {
+	b := wb.barrel
+
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.opts.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(wb.records) == 0 {
+		return nil
+	}
+
+	return b.writeBatch(wb, nil, nil)
+}
+
+// writeBatch writes the records in the batch along with the commit record in a single
+// append and updates the keydir. It's called with the read lock held.
+// If validate is given, it's called after locking the shards of the keys in the batch
+// along with the given extra keys, and the batch is only written if it returns nil.
+func (b *Barrel) writeBatch(wb *Batch, extra []string, validate func() error) error {
+	var (
+		df   = b.df
+		buf  = b.bufPool.Get().(*bytes.Buffer)
+		ends = make([]int, len(wb.records))
+		keys = make([]string, len(wb.records))
+	)
+	defer b.bufPool.Put(buf)
+	defer buf.Reset()
+
+	// Encode all the records of the batch.
+	for i := range wb.records {
+		record := wb.records[i]
+		record.Header.Flags |= flagBatch
+		if err := record.encode(buf, df.Cipher()); err != nil {
+			return fmt.Errorf("error encoding record: %v", err)
+		}
+		ends[i] = buf.Len()
+		keys[i] = record.Key
+	}
+
+	// The commit record stores the number of records in the batch.
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(wb.records)))
+	commit := Record{
+		Header: Header{
+			Timestamp: time.Now().UnixMilli(),
+			Flags:     flagBatchCommit,
+			ValSize:   uint32(len(count)),
+		},
+		Value: count,
+	}
+	if err := commit.encode(buf, df.Cipher()); err != nil {
+		return fmt.Errorf("error encoding record: %v", err)
+	}
+
+	// Lock the shards of all the keys, so that readers never see a partially applied batch.
+	unlock := b.keydir.lockShards(append(keys, extra...))
+
+	if validate != nil {
+		if err := validate(); err != nil {
+			unlock()
+			return err
+		}
+	}
+
+	offset, err := b.append(df, buf.Bytes())
+	if err != nil {
+		unlock()
+		return err
+	}
+
+	// Apply the records to the keydir in the order they were added to the batch.
+	for i, record := range wb.records {
+		s := b.keydir.shard(record.Key)
+		if record.isTombstone() {
+			b.keydir.remove(s, record.Key)
+			continue
+		}
+
+		start := 0
+		if i > 0 {
+			start = ends[i-1]
+		}
+		b.keydir.put(s, record.Key, Meta{
+			Timestamp:  int(record.Header.Timestamp),
+			Expiry:     int(record.Header.Expiry),
+			RecordSize: ends[i] - start,
+			RecordPos:  offset + ends[i],
+			FileID:     df.ID(),
+		})
+	}
+	unlock()
+
+	wb.records = wb.records[:0]
+
+	return b.commit(df, offset+buf.Len())
+}
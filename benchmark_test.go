@@ -2,7 +2,9 @@ package barrel_test
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	barrel "github.com/mr-karan/barreldb"
@@ -18,7 +20,9 @@ func BenchmarkPut(b *testing.B) {
 
 	scenarios := map[string][]barrel.Config{
 		"AlwaysSync":  {barrel.WithDir(tmpDir), barrel.WithAlwaysSync()},
+		"GroupCommit": {barrel.WithDir(tmpDir), barrel.WithGroupCommit()},
 		"DisableSync": {barrel.WithDir(tmpDir)},
+		"SingleShard": {barrel.WithDir(tmpDir), barrel.WithShards(1)},
 	}
 
 	for sc, cfg := range scenarios {
@@ -46,6 +50,34 @@ func BenchmarkPut(b *testing.B) {
 			}
 			b.StopTimer()
 		})
+		b.Run(sc+"_Parallel", func(b *testing.B) {
+			// Size of each value -> 4kb.
+			b.SetBytes(int64(4096))
+			b.ReportAllocs()
+
+			var (
+				val = []byte(strings.Repeat(" ", 4096))
+				n   int64
+			)
+
+			b.ResetTimer()
+
+			// Run more goroutines than CPUs since the writers mostly wait on disk.
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine writes to a different set of keys.
+				prefix := "hello-" + strconv.FormatInt(atomic.AddInt64(&n, 1), 10) + "-"
+				i := 0
+				for pb.Next() {
+					if err := brl.Put(prefix+strconv.Itoa(i%1024), val); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+			b.StopTimer()
+		})
 		brl.Shutdown()
 	}
 }
@@ -90,3 +122,39 @@ func BenchmarkGet(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func BenchmarkPutAfterSnapshot(b *testing.B) {
+	// Create a temp directory for running tests.
+	tmpDir, err := os.MkdirTemp("", "barreldb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	brl, err := barrel.Init(barrel.WithDir(tmpDir), barrel.WithShards(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer brl.Shutdown()
+
+	// Put dummy keys, so that copying the whole shard on write would be expensive.
+	val := []byte("value")
+	for i := 0; i < 100000; i++ {
+		if err := brl.Put("key-"+strconv.Itoa(i), val); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Every write is the first write to the shard after a snapshot is taken.
+	for i := 0; i < b.N; i++ {
+		snap := brl.Snapshot()
+		if err := brl.Put("key-"+strconv.Itoa(i%100000), val); err != nil {
+			b.Fatal(err)
+		}
+		snap.Release()
+	}
+	b.StopTimer()
+}
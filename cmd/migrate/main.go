@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	barrel "github.com/mr-karan/barreldb"
+	flag "github.com/spf13/pflag"
+	"github.com/zerodha/logf"
+)
+
+var (
+	// Version of the build. This is injected at build-time.
+	buildString = "unknown"
+)
+
+// migrate rewrites the datafiles written with an older format version into the current format.
+// The barreldb server must be stopped before running the migration.
+func main() {
+	var (
+		lo = logf.New(logf.Opts{EnableCaller: true})
+		f  = flag.NewFlagSet("migrate", flag.ContinueOnError)
+	)
+
+	// Configure Flags.
+	f.Usage = func() {
+		fmt.Println(f.FlagUsages())
+		os.Exit(0)
+	}
+
+	// Register `--dir` flag.
+	dir := f.String("dir", "./data", "Path to the directory containing the .db files.")
+
+	// Register the encryption key flags.
+	key := f.String("key", "", "Encryption key of the datastore as <id>:<hex key>. Migrated datafiles are encrypted with it.")
+	decKeys := f.StringArray("decryption-key", nil, "Older key for reading encrypted datafiles as <id>:<hex key>. Can be repeated.")
+
+	// Parse and Load Flags.
+	if err := f.Parse(os.Args[1:]); err != nil {
+		lo.Fatal("error parsing flags", "error", err)
+	}
+
+	var cfg []barrel.Config
+	for _, k := range *decKeys {
+		id, secret, err := parseKey(k)
+		if err != nil {
+			lo.Fatal("error parsing decryption key", "error", err)
+		}
+		cfg = append(cfg, barrel.WithDecryptionKey(id, secret))
+	}
+	if *key != "" {
+		id, secret, err := parseKey(*key)
+		if err != nil {
+			lo.Fatal("error parsing encryption key", "error", err)
+		}
+		cfg = append(cfg, barrel.WithEncryptionKey(id, secret))
+	}
+
+	lo.Info("migrating datafiles", "version", buildString, "dir", *dir)
+
+	n, err := barrel.Migrate(*dir, cfg...)
+	if err != nil {
+		lo.Fatal("error migrating datafiles", "error", err, "migrated", n)
+	}
+
+	lo.Info("migration complete", "migrated", n)
+}
+
+// parseKey parses a key given as <id>:<hex key>.
+func parseKey(s string) (uint32, []byte, error) {
+	idStr, keyStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, nil, fmt.Errorf("key must be formatted as <id>:<hex key>")
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid key id %q: %w", idStr, err)
+	}
+
+	key, err := hex.DecodeString(keyStr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid hex key: %w", err)
+	}
+
+	return uint32(id), key, nil
+}
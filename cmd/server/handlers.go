@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	barrel "github.com/mr-karan/barreldb"
+	"github.com/tidwall/match"
 	"github.com/tidwall/redcon"
 )
 
@@ -87,3 +92,89 @@ func (app *App) delete(conn redcon.Conn, cmd redcon.Command) {
 
 	conn.WriteNull()
 }
+
+func (app *App) keys(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	var (
+		pattern = string(cmd.Args[1])
+		keys    = []string{}
+	)
+
+	// Only visit the keys with the literal prefix of the pattern if the ordered index is enabled.
+	it := app.barrel.Scan(barrel.PatternPrefix(pattern), barrel.KeysOnly())
+	defer it.Close()
+	for it.Next() {
+		if match.Match(it.Key(), pattern) {
+			keys = append(keys, it.Key())
+		}
+	}
+
+	switch err := it.Err(); {
+	case errors.Is(err, barrel.ErrNoIndex):
+		keys = keys[:0]
+		for _, k := range app.barrel.List() {
+			if match.Match(k, pattern) {
+				keys = append(keys, k)
+			}
+		}
+	case err != nil:
+		conn.WriteString(fmt.Sprintf("ERR: %s", err))
+		return
+	}
+
+	conn.WriteArray(len(keys))
+	for _, k := range keys {
+		conn.WriteBulkString(k)
+	}
+}
+
+func (app *App) scan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	var (
+		cursor  = string(cmd.Args[1])
+		pattern = "*"
+		count   = 10
+	)
+	for i := 2; i < len(cmd.Args); i += 2 {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "match":
+			pattern = string(cmd.Args[i+1])
+		case "count":
+			n, err := strconv.Atoi(string(cmd.Args[i+1]))
+			if err != nil || n < 1 {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	// A new scan is started and ended with the cursor "0", like in Redis.
+	if cursor == "0" {
+		cursor = ""
+	}
+	keys, next, err := app.barrel.ListPage(cursor, count, pattern)
+	if err != nil {
+		conn.WriteString(fmt.Sprintf("ERR: %s", err))
+		return
+	}
+	if next == "" {
+		next = "0"
+	}
+
+	conn.WriteArray(2)
+	conn.WriteBulkString(next)
+	conn.WriteArray(len(keys))
+	for _, k := range keys {
+		conn.WriteBulkString(k)
+	}
+}
@@ -43,6 +43,19 @@ func main() {
 	if ko.Bool("app.debug") {
 		cfg = append(cfg, barrel.WithDebug())
 	}
+	if ko.Exists("app.merge_threshold") {
+		cfg = append(cfg, barrel.WithMergeThreshold(ko.Float64("app.merge_threshold")))
+	}
+	if ko.Bool("app.ordered_index") {
+		cfg = append(cfg, barrel.WithOrderedIndex())
+	}
+	if name := ko.String("app.compression"); name != "" {
+		codec, ok := barrel.LookupCodec(name)
+		if !ok {
+			app.lo.Fatal("unknown compression codec", "codec", name)
+		}
+		cfg = append(cfg, barrel.WithCompression(codec))
+	}
 
 	// Initialise barrel.
 	barrel, err := barrel.Init(cfg...)
@@ -58,6 +71,8 @@ func main() {
 	mux.HandleFunc("set", app.set)
 	mux.HandleFunc("get", app.get)
 	mux.HandleFunc("del", app.delete)
+	mux.HandleFunc("keys", app.keys)
+	mux.HandleFunc("scan", app.scan)
 
 	// Create a channel to listen for cancellation signals.
 	// Create a new context which is cancelled when `SIGINT`/`SIGTERM` is received.
@@ -0,0 +1,200 @@
+package barrel
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses the values of records before they are written to the datafile.
+// The ID of the codec is stored in the header of every record it compresses, so
+// records compressed with different codecs can be present in the same datafile.
+type Codec interface {
+	// ID uniquely identifies the codec. It must be between 1 and 15 and
+	// must never change once records are written with the codec.
+	ID() uint8
+	// Name is a human readable name for the codec.
+	Name() string
+	// Compress returns the compressed value.
+	Compress(val []byte) ([]byte, error)
+	// Decompress returns the original value from the compressed value.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// IDs of the built-in codecs.
+const (
+	codecNone  uint8 = 0
+	codecFlate uint8 = 1
+	codecGzip  uint8 = 2
+
+	// maxCodecID is the largest ID that can be stored in the record flags.
+	maxCodecID = 15
+)
+
+var (
+	// CodecFlate compresses values with DEFLATE.
+	CodecFlate Codec = &flateCodec{}
+	// CodecGzip compresses values with gzip.
+	CodecGzip Codec = &gzipCodec{}
+
+	codecsMu sync.RWMutex
+	codecs   = map[uint8]Codec{
+		codecFlate: CodecFlate,
+		codecGzip:  CodecGzip,
+	}
+)
+
+// RegisterCodec registers a codec so that the records compressed with it can be read.
+// Custom codecs must be registered before calling Init.
+func RegisterCodec(c Codec) error {
+	if c.ID() == codecNone || c.ID() > maxCodecID {
+		return fmt.Errorf("%w: id %d is out of range", ErrInvalidCodec, c.ID())
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, ok := codecs[c.ID()]; ok {
+		return fmt.Errorf("%w: id %d is already registered", ErrInvalidCodec, c.ID())
+	}
+	codecs[c.ID()] = c
+
+	return nil
+}
+
+// LookupCodec returns the registered codec with the given name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// getCodec returns the registered codec with the given ID.
+func getCodec(id uint8) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d is not registered", ErrInvalidCodec, id)
+	}
+	return c, nil
+}
+
+// compress compresses the value with the configured codec.
+// The value is stored uncompressed if compression doesn't reduce its size.
+// It returns the value to be stored along with the ID of the codec used.
+func (b *Barrel) compress(val []byte) ([]byte, uint8, error) {
+	if b.opts.codec == nil || len(val) == 0 {
+		return val, codecNone, nil
+	}
+
+	data, err := b.opts.codec.Compress(val)
+	if err != nil {
+		return nil, codecNone, fmt.Errorf("error compressing value: %w", err)
+	}
+	if len(data) >= len(val) {
+		return val, codecNone, nil
+	}
+
+	return data, b.opts.codec.ID(), nil
+}
+
+// flateCodec compresses values with DEFLATE. The writers are pooled
+// since allocating a new writer for every record is expensive.
+type flateCodec struct {
+	writers sync.Pool
+}
+
+func (c *flateCodec) ID() uint8 {
+	return codecFlate
+}
+
+func (c *flateCodec) Name() string {
+	return "flate"
+}
+
+func (c *flateCodec) Compress(val []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(val); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// gzipCodec compresses values with gzip. The writers are pooled
+// since allocating a new writer for every record is expensive.
+type gzipCodec struct {
+	writers sync.Pool
+}
+
+func (c *gzipCodec) ID() uint8 {
+	return codecGzip
+}
+
+func (c *gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCodec) Compress(val []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(val); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
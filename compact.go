@@ -1,9 +1,12 @@
 package barrel
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/mr-karan/barreldb/internal/datafile"
@@ -13,10 +16,10 @@ import (
 // It examines the file size of the active db file and marks it as stale
 // if the file size exceeds the configured size.
 func (b *Barrel) ExamineFileSize(evalInterval time.Duration) {
-	var (
-		evalTicker = time.NewTicker(evalInterval).C
-	)
-	for range evalTicker {
+	evalTicker := time.NewTicker(evalInterval)
+	defer evalTicker.Stop()
+
+	for b.tick(evalTicker) {
 		if err := b.rotateDF(); err != nil {
 			b.lo.Error("error rotating db file", "error", err)
 		}
@@ -24,27 +27,22 @@ func (b *Barrel) ExamineFileSize(evalInterval time.Duration) {
 }
 
 // RunCompaction runs cleanup process to compact the keys and cleanup
-// dead/expired keys at a periodic interval. This helps to save disk space
-// and merge old inactive db files in a single file. It also generates a hints file
-// which helps in caching all the keys during a cold start.
+// dead/expired keys at a periodic interval. This helps to save disk space by
+// merging the inactive db files with enough garbage into new db files, each of
+// which is kept under the max size of a db file and gets its own hints file.
 func (b *Barrel) RunCompaction(evalInterval time.Duration) {
-	var (
-		evalTicker = time.NewTicker(evalInterval).C
-	)
-	for range evalTicker {
-		b.Lock()
+	evalTicker := time.NewTicker(evalInterval)
+	defer evalTicker.Stop()
 
+	for b.tick(evalTicker) {
 		if err := b.cleanupExpired(); err != nil {
 			b.lo.Error("error removing expired keys", "error", err)
 		}
+
+		// Merge takes the locks as required, so reads and writes aren't blocked while merging.
 		if err := b.merge(); err != nil {
 			b.lo.Error("error merging old files", "error", err)
 		}
-		if err := b.generateHints(); err != nil {
-			b.lo.Error("error generating hints file", "error", err)
-		}
-
-		b.Unlock()
 	}
 }
 
@@ -52,25 +50,34 @@ func (b *Barrel) RunCompaction(evalInterval time.Duration) {
 // It examines the file size of the active db file and marks it as stale
 // if the file size exceeds the configured size.
 func (b *Barrel) SyncFile(evalInterval time.Duration) {
-	var (
-		evalTicker = time.NewTicker(evalInterval).C
-	)
-	for range evalTicker {
+	evalTicker := time.NewTicker(evalInterval)
+	defer evalTicker.Stop()
+
+	for b.tick(evalTicker) {
 		if err := b.Sync(); err != nil {
 			b.lo.Error("error syncing db file to disk", "error", err)
 		}
 	}
 }
 
+// tick waits for the next tick of the ticker. It returns false once the datastore is shut down.
+func (b *Barrel) tick(ticker *time.Ticker) bool {
+	select {
+	case <-ticker.C:
+		return true
+	case <-b.done:
+		return false
+	}
+}
+
 // rotateDF checks if the active file size has crossed the threshold
 // of max allowed file size. If it has, it replaces the open file descriptors
 // pointing to that file with a new file and adds the current file to list of
-// stale files.
+// stale files. A hints file is generated for the sealed datafile.
 func (b *Barrel) rotateDF() error {
-	b.Lock()
-	defer b.Unlock()
-
+	b.RLock()
 	size, err := b.df.Size()
+	b.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -81,143 +88,595 @@ func (b *Barrel) rotateDF() error {
 		return nil
 	}
 
-	oldID := b.df.ID()
+	_, err = b.rotate(0)
+	return err
+}
 
-	// Add this datafile to list of stale files.
-	b.stale[oldID] = b.df
+// rotate seals the active datafile and replaces it with a new datafile. The given number
+// of IDs are skipped between the sealed and the new datafile and are reserved for the caller.
+// It returns the first reserved ID. A hints file is generated for the sealed datafile.
+func (b *Barrel) rotate(reserve int) (int, error) {
+	b.Lock()
+	sealed, err := b.seal(reserve)
+	b.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return sealed.ID() + 1, b.sealHints(sealed)
+}
+
+// seal adds the active datafile to the stale datafiles and replaces it with a new datafile,
+// skipping the given number of IDs in between. It returns the sealed datafile.
+// It's called with the lock held.
+func (b *Barrel) seal(reserve int) (*datafile.DataFile, error) {
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	sealed := b.df
 
 	// Create a new datafile.
-	df, err := datafile.New(b.opts.dir, oldID+1)
+	df, err := openDataFile(b.opts, b.opts.dir, sealed.ID()+1+reserve)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// Add this datafile to list of stale files.
+	b.stale[sealed.ID()] = sealed
+
 	// Replace with a new instance of datafile.
 	b.df = df
 
-	return nil
+	return sealed, nil
 }
 
-// generateHints encodes the contents of the in-memory hashtable
-// as `gob` and writes the data to a hints file.
-func (b *Barrel) generateHints() error {
-	path := filepath.Join(b.opts.dir, HINTS_FILE)
-	if err := b.keydir.Encode(path); err != nil {
+// sealHints generates the hints file for a sealed datafile.
+func (b *Barrel) sealHints(sealed *datafile.DataFile) error {
+	// Since no more records are written to the sealed file,
+	// the hints can be generated and saved without holding the lock.
+	hints, pos, err := buildHints(sealed, sealed.Start(), nil)
+	if err != nil {
+		return fmt.Errorf("error generating hints file: %w", err)
+	}
+	if err := b.saveHints(sealed, pos, hints); err != nil {
 		return err
 	}
 
+	// If the datafile was merged in the meantime, the merge may have removed
+	// the hints file before it was saved, so it's removed here instead.
+	b.RLock()
+	merged := b.stale[sealed.ID()] != sealed
+	b.RUnlock()
+	if merged {
+		if err := os.Remove(hintsPath(b.opts.dir, sealed.ID())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // cleanupExpired removes the expired keys.
+// The expiry is stored in the keydir, so this doesn't need to read from the disk.
+// Like Delete, it only holds the read lock, so it runs alongside reads and writes.
 func (b *Barrel) cleanupExpired() error {
-	// Iterate over all keys and delete all keys which are expired.
-	for k := range b.keydir {
-		record, err := b.get(k)
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.opts.readOnly {
+		return nil
+	}
+
+	// Iterate over all keys and collect the keys which are expired.
+	var expired []string
+	b.keydir.Range(func(k string, meta Meta) bool {
+		if meta.isExpired() {
+			expired = append(expired, k)
+		}
+		return true
+	})
+
+	// Delete all the expired keys.
+	for _, k := range expired {
+		b.lo.Debug("deleting key since it's expired", "key", k)
+		// The key may have been written again since it was collected.
+		err := b.deleteIf(k, func(meta Meta, ok bool) bool {
+			return ok && meta.isExpired()
+		})
 		if err != nil {
-			b.lo.Error("error fetching key", "key", k, "error", err)
+			b.lo.Error("error deleting key", "key", k, "error", err)
 			continue
 		}
-		if record.isExpired() {
-			b.lo.Debug("deleting key since it's expired", "key", k)
-			// Delete the key.
-			if err := b.delete(k); err != nil {
-				b.lo.Error("error deleting key", "key", k, "error", err)
-				continue
-			}
-		}
 	}
 
 	return nil
 }
 
-// Merge is the process of merging all datafiles in a single file.
-// In this process, all the expired/deleted keys are cleaned up and old files
-// are removed from the disk.
+// Merge is the process of compacting the stale datafiles which have accumulated
+// enough garbage, i.e. the records of keys which were later overwritten, deleted or
+// have expired. Only the datafiles whose ratio of garbage is above the threshold
+// (or which are encrypted with an older key) are merged, and the others are left untouched.
+// The live records of the selected datafiles are copied to new datafiles, which are rotated
+// once they reach the max size of a datafile, and the selected datafiles are removed from
+// the disk. The active file is sealed before merging, so that the merged datafiles get new
+// IDs which are loaded after all the existing datafiles and before the datafiles written
+// to during the merge.
+//
+// The live records are copied from the sealed datafiles without holding any lock, so
+// reads and writes are served from the active datafile during the merge. The keydir
+// entries are then swapped one at a time, skipping the keys which were overwritten or
+// deleted during the merge. The write lock is only held briefly for adding and removing
+// datafiles.
+//
+// The merged datafiles are staged in the MERGE_DIR directory and synced to disk before
+// they're renamed into the data directory. The datafiles which were merged are only removed
+// after that, so the datastore can be recovered after a crash at any step: the staged datafiles
+// which weren't published are discarded on startup, and the published ones only hold copies
+// of the records in the datafiles which were merged.
 func (b *Barrel) merge() error {
-	var (
-		mergefsync bool
-	)
-
-	// There should be atleast 2 old files to merge.
-	if len(b.stale) < 2 {
+	if b.opts.readOnly {
 		return nil
 	}
 
-	// Create a new datafile for storing the output of merged files.
-	// Use a temp directory to store the file and move to main directory after merge is over.
-	tmpMergeDir, err := os.MkdirTemp("", "merged")
-	if err != nil {
+	// Only one merge runs at a time.
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	out, err := b.stageMerge()
+	if err != nil || len(out.ids) == 0 {
 		return err
 	}
-	defer os.RemoveAll(tmpMergeDir)
 
-	mergeDF, err := datafile.New(tmpMergeDir, 0)
+	return b.replaceMerged(out)
+}
+
+// stageMerge seals the active datafile and copies the live records of the datafiles which
+// should be merged to the staged merged datafiles. The output is empty if nothing should be
+// merged. It's called with the merge lock held.
+func (b *Barrel) stageMerge() (mergeOutput, error) {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return mergeOutput{}, ErrClosed
+	}
+	ids := b.mergeCandidates()
+	if len(ids) == 0 {
+		b.Unlock()
+		return mergeOutput{}, nil
+	}
+
+	// Reserve the IDs for the merged datafiles, which are newer than all the sealed datafiles.
+	// The datafiles to merge are collected while holding the lock, so that no writes are made
+	// to them after the number of IDs to reserve is estimated.
+	reserve := b.mergeReserve(ids)
+	sealed, err := b.seal(reserve)
 	if err != nil {
-		return err
+		b.Unlock()
+		return mergeOutput{}, err
 	}
+	in := b.mergeInput(sealed.ID() + 1)
+	b.Unlock()
 
-	// Disable fsync for merge process and manually fsync at the end of merge.
-	if b.opts.alwaysFSync {
-		mergefsync = true
-		b.opts.alwaysFSync = false
+	if err := b.sealHints(sealed); err != nil {
+		return mergeOutput{}, err
 	}
 
-	// Loop over all active keys in the hashmap and write the updated values to merged database.
-	// Since the keydir has updated values of all keys, all the old keys which are expired/deleted/overwritten
-	// will be cleaned up in the merged database.
+	return b.copyLive(sealed.ID()+1, reserve, in)
+}
+
+// mergeCandidates returns the sorted IDs of the stale datafiles which should be merged.
+// It's called with the read lock held.
+func (b *Barrel) mergeCandidates() []int {
+	oldest := -1
+	for id := range b.stale {
+		if oldest == -1 || id < oldest {
+			oldest = id
+		}
+	}
 
-	for k := range b.keydir {
-		record, err := b.get(k)
+	var ids, empty []int
+	for id, df := range b.stale {
+		size, err := df.Size()
 		if err != nil {
-			return err
+			b.lo.Error("error getting size of db file", "id", id, "error", err)
+			continue
 		}
-		if err := b.put(mergeDF, k, record.Value, nil); err != nil {
-			return err
+
+		var (
+			data    = size - int64(df.Start())
+			live    = b.keydir.stats.get(id)
+			garbage float64
+		)
+		// The tombstones kept by a merge are only needed while there's an older datafile,
+		// which may still have records for their keys. Once all the older datafiles are
+		// merged, they're garbage, just like merging the datafile would drop them.
+		if id > oldest {
+			live += b.keydir.stats.getTombstones(id)
+		}
+		if data > 0 {
+			garbage = float64(data-live) / float64(data)
+		}
+
+		switch {
+		case size == int64(df.Start()):
+			empty = append(empty, id)
+		case garbage >= b.opts.mergeThreshold || b.reencrypt(df):
+			ids = append(ids, id)
 		}
 	}
 
-	// Now close all the existing datafile handlers.
-	for _, df := range b.stale {
-		if err := df.Close(); err != nil {
-			b.lo.Error("error closing df", "id", df.ID(), "error", err)
+	// Datafiles without any records are only removed along with other datafiles,
+	// since merging requires sealing the active datafile, which might be empty as well.
+	if len(ids) > 0 {
+		ids = append(ids, empty...)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// mergeReserve returns the number of IDs to reserve for the merged datafiles, which is an
+// upper bound of the number of merged datafiles. It's computed from the size of the given
+// datafiles and the active datafile, which is sealed and may be merged as well. It's called
+// with the lock held, so that the datafiles don't grow after this.
+//
+// Every record in the merged datafiles is a copy of a record in the datafiles which are merged,
+// or a tombstone replacing the record of an expired key, which is smaller than the record.
+// A copied record can only be larger if it's rewritten with a larger header or re-encrypted.
+// A merged datafile is only rotated once the next record doesn't fit, so every two consecutive
+// datafiles hold more than the max size. Every merged datafile holds at least one record,
+// so there can't be more merged datafiles than records either.
+func (b *Barrel) mergeReserve(ids []int) int {
+	dfs := []*datafile.DataFile{b.df}
+	for _, id := range ids {
+		dfs = append(dfs, b.stale[id])
+	}
+
+	var aead cipher.AEAD
+	if b.opts.encrypt {
+		aead = b.opts.ciphers[b.opts.encKeyID]
+	}
+
+	var total, records int64
+	for _, df := range dfs {
+		size, err := df.Size()
+		if err != nil {
+			b.lo.Error("error getting size of db file", "id", df.ID(), "error", err)
 			continue
 		}
+
+		var (
+			data = size - int64(df.Start())
+			// Every record has a key of at least a byte.
+			n     = data / int64(recordSize(Header{KeySize: 1}, df.Version(), df.Cipher()))
+			extra = recordSize(Header{}, datafile.CurrentVersion, aead) - recordSize(Header{}, df.Version(), df.Cipher())
+		)
+		records += n
+		total += data
+		if extra > 0 {
+			total += n * int64(extra)
+		}
+	}
+
+	files := records
+	if room := b.opts.maxActiveFileSize - datafile.HeaderSize; room > 0 && 2*total/room+1 < files {
+		files = 2*total/room + 1
 	}
+	return int(files) + 1
+}
 
-	// Reset the old map.
-	b.stale = make(map[int]*datafile.DataFile, 0)
+// reencrypt returns true if the datafile isn't encrypted with the current encryption key.
+func (b *Barrel) reencrypt(df *datafile.DataFile) bool {
+	if df.Encrypted() != b.opts.encrypt {
+		return true
+	}
+	return b.opts.encrypt && df.Header().KeyID != b.opts.encKeyID
+}
 
-	// Delete the existing .db files
-	err = filepath.Walk(b.opts.dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// mergeInput holds the datafiles which are merged.
+type mergeInput struct {
+	files    map[int]*datafile.DataFile // Datafiles to merge by their IDs.
+	unmerged int                        // ID of the oldest datafile which isn't merged.
+}
+
+// mergeInput collects the datafiles older than the given ID which should be merged.
+// The datafiles are only removed by the merge, so they can be read without holding
+// the lock while the live records are copied. It's called with the lock held.
+func (b *Barrel) mergeInput(id int) mergeInput {
+	in := mergeInput{
+		files:    make(map[int]*datafile.DataFile),
+		unmerged: id,
+	}
+	for _, i := range b.mergeCandidates() {
+		if i < id {
+			in.files[i] = b.stale[i]
 		}
-		if info.IsDir() {
-			return nil
+	}
+	for i := range b.stale {
+		if _, ok := in.files[i]; !ok && i < in.unmerged {
+			in.unmerged = i
 		}
-		if filepath.Ext(path) == ".db" {
-			err := os.Remove(path)
+	}
+	return in
+}
+
+// mergeOutput holds the merged datafiles along with the keys copied to them.
+type mergeOutput struct {
+	dfs     []*datafile.DataFile
+	ids     []int           // IDs of the datafiles which were merged.
+	metas   map[string]Meta // Metadata of the keys in the merged datafiles before they were merged.
+	hints   []hint          // Hints for the records in the merged datafiles, including the tombstones.
+	expired []string        // Expired keys which weren't copied to the merged datafiles.
+}
+
+// copyLive copies the live records in the given datafiles to new datafiles, which are
+// staged in the MERGE_DIR directory. A new datafile is started once the current one would
+// exceed the max size of a datafile. The datafiles take the given number of reserved IDs
+// starting at id, which must be newer than all the stale datafiles. An error is returned
+// if more datafiles are needed than the reserved IDs.
+func (b *Barrel) copyLive(id, reserved int, in mergeInput) (mergeOutput, error) {
+	out := mergeOutput{
+		metas: make(map[string]Meta),
+	}
+	for i := range in.files {
+		out.ids = append(out.ids, i)
+	}
+	sort.Ints(out.ids)
+
+	// Create the datafiles for storing the output of merged files. The staging directory
+	// is inside the data directory, so the datafiles can be renamed into it.
+	dir := filepath.Join(b.opts.dir, MERGE_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return out, err
+	}
+
+	fail := func(err error) (mergeOutput, error) {
+		for _, df := range out.dfs {
+			df.Close()
+		}
+		os.RemoveAll(dir)
+		return out, err
+	}
+
+	// Loop over all keys in the hashmap which are present in the merged files and write the
+	// updated values to merged database. Since the keydir has updated values of all keys,
+	// all the old keys which are expired/deleted/overwritten will be cleaned up in the merged database.
+	b.keydir.Range(func(k string, meta Meta) bool {
+		if _, ok := in.files[meta.FileID]; ok {
+			out.metas[k] = meta
+		}
+		return true
+	})
+
+	// Tombstones and expired records can only be dropped if there's no older record for the key
+	// in a datafile which isn't merged, or the older record would be live again on startup.
+	tombstones, err := b.tombstones(in)
+	if err != nil {
+		return fail(err)
+	}
+
+	var (
+		buf     bytes.Buffer
+		mergeDF *datafile.DataFile
+		size    int64 // Size of the current merged datafile.
+		write   = func(record Record, h hint) error {
+			// Start a new datafile if the record doesn't fit in the current one.
+			// Every datafile has at least one record, even if it's larger than the max size.
+			if mergeDF == nil || (size+int64(recordSize(record.Header, datafile.CurrentVersion, mergeDF.Cipher())) > b.opts.maxActiveFileSize &&
+				size > int64(mergeDF.Start())) {
+				if len(out.dfs) == reserved {
+					return fmt.Errorf("merged datafiles exceed the %d reserved IDs", reserved)
+				}
+				df, err := openDataFile(b.opts, dir, id+len(out.dfs))
+				if err != nil {
+					return err
+				}
+				out.dfs = append(out.dfs, df)
+				mergeDF, size = df, int64(df.Start())
+			}
+
+			buf.Reset()
+			if err := record.encode(&buf, mergeDF.Cipher()); err != nil {
+				return err
+			}
+			offset, err := mergeDF.Write(buf.Bytes())
 			if err != nil {
 				return err
 			}
+			size = int64(offset + buf.Len())
+
+			h.Meta = Meta{
+				Timestamp:  int(record.Header.Timestamp),
+				Expiry:     int(record.Header.Expiry),
+				RecordSize: buf.Len(),
+				RecordPos:  offset + buf.Len(),
+				FileID:     mergeDF.ID(),
+			}
+			out.hints = append(out.hints, h)
+			return nil
 		}
-		return nil
-	})
-	if err != nil {
+	)
+
+	for k, meta := range out.metas {
+		// Expired keys are dropped from the merged datafiles.
+		if meta.isExpired() {
+			out.expired = append(out.expired, k)
+			if meta.FileID > in.unmerged {
+				tombstones[k] = meta.Timestamp
+			}
+			continue
+		}
+
+		// The record is copied with its original header, so the timestamp, the expiry
+		// and the codec of the value are preserved. The value isn't decompressed, so
+		// it's readable even if the datastore is now configured with another codec.
+		// The record isn't part of a batch in the merged datafiles anymore.
+		record, err := readRecord(in.files[meta.FileID], k, meta)
+		if err != nil {
+			return fail(err)
+		}
+		record.Header.Flags &^= flagBatch | flagBatchCommit
+
+		if err := write(record, hint{Key: k}); err != nil {
+			return fail(err)
+		}
+	}
+
+	for k, ts := range tombstones {
+		record := Record{
+			Header: Header{
+				Timestamp: int64(ts),
+				Flags:     flagTombstone,
+				KeySize:   uint32(len(k)),
+			},
+			Key: k,
+		}
+		if err := write(record, hint{Key: k, Tombstone: true}); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Flush the merged datafiles to disk before publishing them.
+	for _, df := range out.dfs {
+		if err := df.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return fail(err)
+	}
+
+	return out, nil
+}
+
+// tombstones returns the keys which are deleted and have a tombstone in the merged
+// datafiles newer than the oldest datafile which isn't merged, along with the timestamp
+// of the tombstone. These tombstones must be kept while merging, since the older
+// datafile may have a record for the key.
+func (b *Barrel) tombstones(in mergeInput) (map[string]int, error) {
+	tombstones := make(map[string]int)
+	for id, df := range in.files {
+		if id < in.unmerged {
+			continue
+		}
+
+		res := b.loadHints(df)
+		if res.err != nil {
+			return nil, fmt.Errorf("error loading hints for datafile %d: %w", id, res.err)
+		}
+
+		for _, h := range res.hints {
+			if !h.Tombstone {
+				continue
+			}
+			if _, ok := b.keydir.Get(h.Key); !ok && h.Meta.Timestamp >= tombstones[h.Key] {
+				tombstones[h.Key] = h.Meta.Timestamp
+			}
+		}
+	}
+	return tombstones, nil
+}
+
+// replaceMerged publishes the merged datafiles, points the keydir to them and removes the
+// datafiles which were merged. Keys which were overwritten or deleted while the records were
+// being copied are left untouched.
+func (b *Barrel) replaceMerged(out mergeOutput) error {
+	dir := filepath.Join(b.opts.dir, MERGE_DIR)
+	if err := b.publish(out.dfs, dir); err != nil {
+		return fmt.Errorf("error publishing merged datafiles: %w", err)
+	}
+
+	// The entries are swapped while holding the lock of their shard, so that
+	// the keys which were written in the meantime aren't overwritten.
+	hints := make(map[int][]hint, len(out.dfs))
+	for _, h := range out.hints {
+		hints[h.Meta.FileID] = append(hints[h.Meta.FileID], h)
+		if h.Tombstone {
+			// The tombstones which are kept are tracked, so that the merged datafile
+			// isn't merged again only because of them while they're still needed.
+			b.keydir.stats.addTombstones(h.Meta.FileID, h.Meta.RecordSize)
+			continue
+		}
+		b.keydir.swap(h.Key, out.metas[h.Key], h.Meta)
+	}
+	for _, k := range out.expired {
+		b.keydir.swap(k, out.metas[k], Meta{})
+	}
+
+	// Reads which looked up a key before it was swapped hold the read lock until they're done,
+	// so the merged datafiles are removed from the stale datafiles after they're finished.
+	b.Lock()
+	merged := make([]*datafile.DataFile, 0, len(out.ids))
+	for _, id := range out.ids {
+		merged = append(merged, b.stale[id])
+		delete(b.stale, id)
+	}
+	b.Unlock()
+
+	// Remove the hints for the old files, since they're no longer valid.
+	for _, id := range out.ids {
+		if err := os.Remove(hintsPath(b.opts.dir, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Now close all the merged datafile handlers and delete the older files.
+	// Datafiles pinned by a snapshot are closed once the snapshot is released.
+	for _, df := range merged {
+		b.keydir.stats.drop(df.ID())
+		if err := b.retire(df); err != nil {
+			b.lo.Error("error closing df", "id", df.ID(), "error", err)
+		}
+		if err := os.Remove(filepath.Join(b.opts.dir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, df.ID()))); err != nil {
+			return err
+		}
+	}
+
+	// Generate the hints files for the merged datafiles.
+	for _, df := range out.dfs {
+		offset, err := df.Size()
+		if err != nil {
+			return err
+		}
+		if err := b.saveHints(df, int(offset), hints[df.ID()]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publish moves the merged datafiles from the staging directory to the data directory
+// and adds them to the stale datafiles. The renames are made durable before returning,
+// so that the datafiles which were merged can be removed after it.
+func (b *Barrel) publish(dfs []*datafile.DataFile, dir string) error {
+	fail := func(err error) error {
+		for _, df := range dfs {
+			df.Close()
+		}
+		os.RemoveAll(dir)
 		return err
 	}
 
-	// Move the merged file to the main directory.
-	os.Rename(filepath.Join(tmpMergeDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 0)),
-		filepath.Join(b.opts.dir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 0)))
+	for _, df := range dfs {
+		name := fmt.Sprintf(datafile.ACTIVE_DATAFILE, df.ID())
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(b.opts.dir, name)); err != nil {
+			return fail(err)
+		}
+	}
+	if err := syncDir(b.opts.dir); err != nil {
+		return fail(err)
+	}
 
-	// Set the merged DF as the active DF.
-	b.df = mergeDF
+	b.Lock()
+	for _, df := range dfs {
+		b.stale[df.ID()] = df
+	}
+	b.Unlock()
 
-	if mergefsync {
-		b.opts.alwaysFSync = true
-		b.df.Sync()
+	// The staging directory is empty after this.
+	if err := os.Remove(dir); err != nil {
+		b.lo.Error("error removing merge directory", "error", err)
 	}
 
 	return nil
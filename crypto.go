@@ -0,0 +1,241 @@
+package barrel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
+)
+
+const (
+	// sealChunkSize is the max size of plaintext sealed in a single chunk of an encrypted hints file.
+	sealChunkSize = 64 << 10
+)
+
+// newCipher creates an AES-GCM cipher with the given key.
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealOverhead returns the additional bytes added to every record sealed with the cipher.
+func sealOverhead(aead cipher.AEAD) int {
+	if aead == nil {
+		return 0
+	}
+	return aead.NonceSize() + aead.Overhead()
+}
+
+// seal encrypts the plaintext with a random nonce and appends the nonce
+// followed by the ciphertext to dst.
+func seal(aead cipher.AEAD, dst []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, aad), nil
+}
+
+// open decrypts the data sealed with seal.
+func open(aead cipher.AEAD, data []byte, aad []byte) ([]byte, error) {
+	if len(data) < sealOverhead(aead) {
+		return nil, ErrDecryption
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+
+	return plaintext, nil
+}
+
+// openDataFile opens the datafile with the given ID. New datafiles are encrypted
+// with the active encryption key. For existing encrypted datafiles, the key is
+// looked up with the key ID stored in the file header.
+func openDataFile(opts *Options, dir string, id int) (*datafile.DataFile, error) {
+	df, err := datafile.New(dir, id, dataFileOptions(opts)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadCipher(opts, df); err != nil {
+		df.Close()
+		return nil, err
+	}
+
+	return df, nil
+}
+
+// dataFileOptions returns the options for creating new datafiles.
+func dataFileOptions(opts *Options) []datafile.Option {
+	var dfOpts []datafile.Option
+	if opts.encrypt {
+		dfOpts = append(dfOpts, datafile.WithEncryption(opts.encKeyID, opts.ciphers[opts.encKeyID]))
+	}
+	return dfOpts
+}
+
+// loadCipher sets the cipher of an encrypted datafile to the key with the ID stored in its header.
+func loadCipher(opts *Options, df *datafile.DataFile) error {
+	if !df.Encrypted() {
+		return nil
+	}
+
+	aead, ok := opts.ciphers[df.Header().KeyID]
+	if !ok {
+		return fmt.Errorf("%w: key id %d for datafile %d", ErrMissingKey, df.Header().KeyID, df.ID())
+	}
+	df.SetCipher(aead)
+	return nil
+}
+
+// sealWriter encrypts the data written to it in chunks.
+// Each chunk is written as the length of the sealed chunk followed by the sealed chunk.
+// The index of the chunk and whether it's the final chunk are used as the additional data,
+// so chunks can't be reordered or dropped from the end.
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+func newSealWriter(w io.Writer, aead cipher.AEAD) *sealWriter {
+	return &sealWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, sealChunkSize),
+	}
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := sealChunkSize - len(s.buf)
+		if c > len(p) {
+			c = len(p)
+		}
+		s.buf = append(s.buf, p[:c]...)
+		p = p[c:]
+
+		if len(s.buf) == sealChunkSize {
+			if err := s.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close seals the remaining data as the final chunk. It doesn't close the underlying writer.
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(final bool) error {
+	aad := chunkAAD(s.index, final)
+
+	sealed, err := seal(s.aead, make([]byte, 4, 4+len(s.buf)+sealOverhead(s.aead)), s.buf, aad)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(sealed, uint32(len(sealed)-4))
+
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+
+	s.buf = s.buf[:0]
+	s.index++
+	return nil
+}
+
+// chunkAAD returns the additional data for the chunk with the given index.
+func chunkAAD(index uint64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.LittleEndian.PutUint64(aad, index)
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// openReader decrypts the chunks written by sealWriter.
+type openReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	final bool // Whether the final chunk has been read.
+}
+
+func newOpenReader(r io.Reader, aead cipher.AEAD) *openReader {
+	return &openReader{r: r, aead: aead}
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.final {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next chunk.
+func (o *openReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(o.r, size[:]); err != nil {
+		// The data ends before the final chunk.
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	n := binary.LittleEndian.Uint32(size[:])
+	if n > sealChunkSize+uint32(sealOverhead(o.aead)) {
+		return ErrDecryption
+	}
+
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	// Try opening the chunk as an intermediate chunk first and then as the final chunk.
+	plaintext, err := open(o.aead, sealed, chunkAAD(o.index, false))
+	if err != nil {
+		if plaintext, err = open(o.aead, sealed, chunkAAD(o.index, true)); err != nil {
+			return err
+		}
+		o.final = true
+	}
+
+	o.buf = plaintext
+	o.index++
+	return nil
+}
@@ -0,0 +1,147 @@
+package barrel
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"hash/maphash"
+	"strings"
+
+	"github.com/tidwall/match"
+)
+
+const (
+	defaultPageSize = 10
+
+	cursorOrdered = byte(1) // Cursor over the ordered index.
+	cursorShards  = byte(2) // Cursor over the shards of the keydir.
+)
+
+// cursor is the position of a paginated listing of the keys.
+// Without the ordered index, the keys are listed shard by shard and in sorted order
+// within each shard. With it, they're listed in sorted order.
+type cursor struct {
+	shard int    // Index of the shard to list the keys from.
+	after string // Last key which was visited. Empty if no key has been visited yet.
+}
+
+// encodeCursor returns the opaque string form of the cursor for the keydir.
+func (kd *KeyDir) encodeCursor(c cursor) string {
+	var buf []byte
+	if kd.index != nil {
+		buf = append(buf, cursorOrdered)
+	} else {
+		// The shard of a key depends on the hash seed, so the seed is stored
+		// as well to reject cursors from an earlier instance of the keydir.
+		buf = append(buf, cursorShards)
+		buf = binary.BigEndian.AppendUint64(buf, kd.seedID())
+		buf = binary.BigEndian.AppendUint32(buf, uint32(c.shard))
+	}
+	buf = append(buf, c.after...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeCursor parses a cursor returned by encodeCursor. An empty string is the first position.
+func (kd *KeyDir) decodeCursor(s string) (cursor, error) {
+	if s == "" {
+		return cursor{}, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	if kd.index != nil {
+		if buf[0] != cursorOrdered {
+			return cursor{}, ErrInvalidCursor
+		}
+		return cursor{after: string(buf[1:])}, nil
+	}
+
+	if buf[0] != cursorShards || len(buf) < 13 || binary.BigEndian.Uint64(buf[1:9]) != kd.seedID() {
+		return cursor{}, ErrInvalidCursor
+	}
+	c := cursor{shard: int(binary.BigEndian.Uint32(buf[9:13])), after: string(buf[13:])}
+	if c.shard >= len(kd.shards) {
+		return cursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// seedID identifies the hash seed of the keydir without revealing it.
+func (kd *KeyDir) seedID() uint64 {
+	return maphash.String(kd.seed, "cursor")
+}
+
+// ListPage returns up to count keys which match the glob pattern, starting at the cursor,
+// along with the cursor for the next page. An empty cursor starts a new listing and an
+// empty next cursor is returned once all the keys are listed.
+//
+// Like SCAN in Redis, count is the number of keys visited in a call, so fewer keys are
+// returned if some of them don't match the pattern or have expired. A key which exists
+// for the whole listing is returned exactly once, while keys written or deleted during
+// the listing may or may not be returned. Cursors are valid until the datastore is reopened.
+// With the ordered index, only the keys with the literal prefix of the pattern are visited.
+func (b *Barrel) ListPage(cur string, count int, pattern string) ([]string, string, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	c, err := b.keydir.decodeCursor(cur)
+	if err != nil {
+		return nil, "", err
+	}
+	if count <= 0 {
+		count = defaultPageSize
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	keys := []string{}
+	if b.keydir.index != nil {
+		prefix := PatternPrefix(pattern)
+		visited, done := b.keydir.indexPage(c.after, prefix, prefixEnd(prefix), count)
+		for _, k := range visited {
+			// Keys deleted since they were visited in the index are skipped.
+			meta, ok := b.keydir.Get(k)
+			if ok && !meta.isExpired() && match.Match(k, pattern) {
+				keys = append(keys, k)
+			}
+		}
+		if done {
+			return keys, "", nil
+		}
+		return keys, b.keydir.encodeCursor(cursor{after: visited[len(visited)-1]}), nil
+	}
+
+	// Continue with the next shard till count keys are visited.
+	for count > 0 && c.shard < len(b.keydir.shards) {
+		visited, done := b.keydir.page(c.shard, c.after, count)
+		for _, e := range visited {
+			if !e.meta.isExpired() && match.Match(e.key, pattern) {
+				keys = append(keys, e.key)
+			}
+		}
+		count -= len(visited)
+
+		if done {
+			c = cursor{shard: c.shard + 1}
+		} else {
+			c.after = visited[len(visited)-1].key
+		}
+	}
+
+	if c.shard == len(b.keydir.shards) {
+		return keys, "", nil
+	}
+	return keys, b.keydir.encodeCursor(c), nil
+}
+
+// PatternPrefix returns the literal prefix of a glob pattern before the first special character.
+// All the keys matching the pattern start with the prefix, so it can be passed to Scan.
+func PatternPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
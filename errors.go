@@ -1,12 +1,18 @@
 package barrel
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
+)
 
 var (
 	ErrLocked   = errors.New("a lockfile already exists")
 	ErrReadOnly = errors.New("operation not allowed in read only mode")
+	ErrClosed   = errors.New("datastore is shut down")
 
-	ErrChecksumMismatch = errors.New("invalid data: checksum does not match")
+	ErrChecksumMismatch   = errors.New("invalid data: checksum does not match")
+	ErrUnsupportedVersion = datafile.ErrUnsupportedVersion
 
 	ErrEmptyKey   = errors.New("invalid key: key cannot be empty")
 	ErrExpiredKey = errors.New("invalid key: key is already expired")
@@ -14,4 +20,19 @@ var (
 	ErrNoKey      = errors.New("invalid key: key is either deleted or expired or unset")
 
 	ErrLargeValue = errors.New("invalid value: size cannot be more than 4294967296 bytes")
+
+	ErrConflict         = errors.New("transaction conflict: a key read in the transaction was modified")
+	ErrSnapshotReleased = errors.New("snapshot is already released")
+	ErrNoIndex          = errors.New("ordered index is not enabled")
+	ErrReverseDiskOrder = errors.New("reverse iteration is not possible in disk order")
+	ErrInvalidCursor    = errors.New("invalid cursor")
+
+	ErrInvalidCodec = errors.New("invalid codec")
+
+	ErrInvalidKey = errors.New("invalid encryption key")
+	ErrMissingKey = errors.New("encryption key not found")
+	ErrDecryption = errors.New("invalid data: decryption failed")
+
+	errTornRecord   = errors.New("incomplete or corrupted record")
+	errInvalidHints = errors.New("invalid hints file")
 )
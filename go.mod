@@ -6,6 +6,8 @@ require (
 	github.com/knadh/koanf v1.4.4
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.8.0
+	github.com/tidwall/btree v1.6.0
+	github.com/tidwall/match v1.1.1
 	github.com/tidwall/redcon v1.6.0
 	github.com/zerodha/logf v0.5.5
 	golang.org/x/sys v0.3.0
@@ -19,7 +21,5 @@ require (
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/tidwall/btree v1.6.0 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,33 +2,77 @@ package barrel
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"time"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
 )
 
 const (
 	MaxKeySize   = 1<<32 - 1
 	MaxValueSize = 1<<32 - 1
+
+	// checksumSize is the size in bytes of the checksum at the start of the header.
+	checksumSize = 4
+	// maxHeaderSize is the size in bytes of the largest record header across all format versions.
+	maxHeaderSize = 29
+)
+
+// Flags stored in the record header.
+// The lower 4 bits are used for boolean flags and the upper
+// 4 bits store the ID of the codec used for compressing the value.
+const (
+	// flagTombstone marks the record as deleted.
+	flagTombstone uint8 = 1 << iota
+	// flagBatch marks the record as part of a batch which is applied only if its commit marker is present.
+	flagBatch
+	// flagBatchCommit marks the commit record written after all the records of a batch.
+	// Its value stores the number of records in the batch.
+	flagBatchCommit
+
+	flagCodecShift       = 4
+	flagCodecMask  uint8 = 0xf0
 )
 
+// crcTable is the Castagnoli polynomial table used for computing checksums.
+// CRC32C is hardware accelerated on most modern CPUs.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 /*
 Record is a binary representation of how each record is persisted in the disk.
 Header represents how the record is stored and some metadata with it.
-For storing CRC checksum hash, timestamp and expiry of record, each field uses 4 bytes. (uint32 == 32 bits).
+CRC checksum hash uses 4 bytes (uint32 == 32 bits).
+Timestamp and expiry of the record are stored as milliseconds since the Unix epoch and use 8 bytes each (int64).
+A single byte stores the flags for the record, like whether the record is a tombstone
+and the codec used for compressing the value.
 The next field stores the max size of the key which is also represented with uint32. So the max size of the key
 can not be more than 2^32-1 which is ~ 4.3GB.
 The next field stores the max size of the value which is also represented with unint32. Max size of value can not be more
 than 2^32-1 which is ~ 4.3GB.
 
+The CRC32C (Castagnoli) checksum covers every field of the record following it,
+i.e. all the header fields along with the key and the value.
+
+Every datafile starts with a file header (see datafile.FileHeader) which stores the
+format version used for encoding the records in that file. Records in datafiles
+older than datafile.Version3 don't have the flags field and use an empty value as a tombstone.
+Records in datafiles older than datafile.Version4 store the timestamp and expiry as
+seconds in 4 bytes each, which are converted to milliseconds while decoding.
+
+In encrypted datafiles, the key and value are sealed with AES-GCM. A random nonce
+is stored before the sealed key and value, and the header is authenticated as additional data.
+
 Each entry cannot exceed more than ~8.6GB as a theoretical limit.
 In a practical sense, this is also constrained by the memory of the underlying VM
 where this program would run.
 
 Representation of the record stored on disk.
-------------------------------------------------------------------------------
-| crc(4) | time(4) | expiry (4) | key_size(4) | val_size(4) | key | val      |
-------------------------------------------------------------------------------
+-----------------------------------------------------------------------------------------
+| crc(4) | time(8) | expiry (8) | flags(1) | key_size(4) | val_size(4) | key | val      |
+-----------------------------------------------------------------------------------------
 */
 type Record struct {
 	Header Header
@@ -39,32 +83,214 @@ type Record struct {
 // Header represents the fixed width fields present at the start of every record.
 type Header struct {
 	Checksum  uint32
-	Timestamp uint32
-	Expiry    uint32
+	Timestamp int64 // Milliseconds since Unix epoch.
+	Expiry    int64 // Milliseconds since Unix epoch. 0 if no expiry is set.
+	Flags     uint8
 	KeySize   uint32
 	ValSize   uint32
 }
 
+// headerSize returns the size in bytes of the record header for the given format version.
+func headerSize(version int) int {
+	switch {
+	case version < datafile.Version3:
+		return 20
+	case version < datafile.Version4:
+		return 21
+	default:
+		return 29
+	}
+}
+
 // Encode takes a byte buffer, encodes the value of header and writes to the buffer.
+// The header is always encoded in the current format version.
 func (h *Header) encode(buf *bytes.Buffer) error {
-	return binary.Write(buf, binary.LittleEndian, h)
+	var b [maxHeaderSize]byte
+
+	binary.LittleEndian.PutUint32(b[0:], h.Checksum)
+	binary.LittleEndian.PutUint64(b[4:], uint64(h.Timestamp))
+	binary.LittleEndian.PutUint64(b[12:], uint64(h.Expiry))
+	b[20] = h.Flags
+	binary.LittleEndian.PutUint32(b[21:], h.KeySize)
+	binary.LittleEndian.PutUint32(b[25:], h.ValSize)
+
+	_, err := buf.Write(b[:headerSize(datafile.CurrentVersion)])
+	return err
 }
 
 // Decode takes a record object decodes the binary value the buffer.
-func (h *Header) decode(record []byte) error {
-	return binary.Read(bytes.NewReader(record), binary.LittleEndian, h)
+// The version decides the layout of the header.
+func (h *Header) decode(record []byte, version int) error {
+	if len(record) < headerSize(version) {
+		return fmt.Errorf("invalid header size: %d", len(record))
+	}
+
+	h.Checksum = binary.LittleEndian.Uint32(record[0:])
+
+	if version >= datafile.Version4 {
+		h.Timestamp = int64(binary.LittleEndian.Uint64(record[4:]))
+		h.Expiry = int64(binary.LittleEndian.Uint64(record[12:]))
+		h.Flags = record[20]
+		h.KeySize = binary.LittleEndian.Uint32(record[21:])
+		h.ValSize = binary.LittleEndian.Uint32(record[25:])
+		return nil
+	}
+
+	// Older versions store the timestamp and expiry in seconds.
+	h.Timestamp = int64(binary.LittleEndian.Uint32(record[4:])) * 1000
+	h.Expiry = int64(binary.LittleEndian.Uint32(record[8:])) * 1000
+
+	// Older versions don't have flags and store an empty value as the tombstone.
+	if version < datafile.Version3 {
+		h.KeySize = binary.LittleEndian.Uint32(record[12:])
+		h.ValSize = binary.LittleEndian.Uint32(record[16:])
+		h.Flags = 0
+		if h.ValSize == 0 {
+			h.Flags = flagTombstone
+		}
+		return nil
+	}
+
+	h.Flags = record[12]
+	h.KeySize = binary.LittleEndian.Uint32(record[13:])
+	h.ValSize = binary.LittleEndian.Uint32(record[17:])
+
+	return nil
 }
 
-// isExpired returns true if the key has already expired.
-func (r *Record) isExpired() bool {
+// isExpired returns true if the given expiry time (in milliseconds) is in the past.
+func isExpired(expiry int64) bool {
 	// If no expiry is set, this value will be 0.
-	if r.Header.Expiry == 0 {
+	if expiry == 0 {
 		return false
 	}
-	return time.Now().Unix() > int64(r.Header.Expiry)
+	return time.Now().UnixMilli() > expiry
+}
+
+// isTombstone returns true if the record marks the key as deleted.
+func (r *Record) isTombstone() bool {
+	return r.Header.Flags&flagTombstone != 0
+}
+
+// isBatch returns true if the record is part of a batch.
+func (r *Record) isBatch() bool {
+	return r.Header.Flags&flagBatch != 0
+}
+
+// isBatchCommit returns true if the record is the commit marker of a batch.
+func (r *Record) isBatchCommit() bool {
+	return r.Header.Flags&flagBatchCommit != 0
+}
+
+// codec returns the ID of the codec used for compressing the value.
+func (h *Header) codec() uint8 {
+	return (h.Flags & flagCodecMask) >> flagCodecShift
+}
+
+// setCodec stores the ID of the codec used for compressing the value.
+func (h *Header) setCodec(id uint8) {
+	h.Flags = (h.Flags &^ flagCodecMask) | (id << flagCodecShift)
+}
+
+// value returns the value of the record, decompressing it if required.
+func (r *Record) value() ([]byte, error) {
+	id := r.Header.codec()
+	if id == codecNone {
+		return r.Value, nil
+	}
+
+	c, err := getCodec(id)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := c.Decompress(r.Value)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing value: %w", err)
+	}
+
+	return val, nil
+}
+
+// recordSize returns the size in bytes of the encoded record with the given header.
+// Records in encrypted datafiles have additional bytes for the nonce and the authentication tag.
+func recordSize(h Header, version int, aead cipher.AEAD) int {
+	return headerSize(version) + int(h.KeySize) + int(h.ValSize) + sealOverhead(aead)
 }
 
-// isValidChecksum returns true if the checksum of the value matches what is stored in the header.
-func (r *Record) isValidChecksum() bool {
-	return crc32.ChecksumIEEE(r.Value) == r.Header.Checksum
+// decodeRecord decodes the encoded record after verifying the checksum. If the
+// datafile is encrypted, the key and value are decrypted with the given cipher.
+func decodeRecord(data []byte, version int, aead cipher.AEAD) (Record, error) {
+	var header Header
+	if err := header.decode(data, version); err != nil {
+		return Record{}, fmt.Errorf("error decoding header: %v", err)
+	}
+
+	// A corrupted header can point outside of the record.
+	if len(data) != recordSize(header, version, aead) {
+		return Record{}, ErrChecksumMismatch
+	}
+
+	// Datafiles with the legacy format only have a CRC32 (IEEE) checksum of the value.
+	if version == datafile.VersionLegacy {
+		if crc32.ChecksumIEEE(data[len(data)-int(header.ValSize):]) != header.Checksum {
+			return Record{}, ErrChecksumMismatch
+		}
+	} else if crc32.Checksum(data[checksumSize:], crcTable) != header.Checksum {
+		return Record{}, ErrChecksumMismatch
+	}
+
+	var (
+		hdrSize = headerSize(version)
+		kv      = data[hdrSize:]
+	)
+
+	// The header is used as additional data, so it's authenticated along with the key and value.
+	if aead != nil {
+		plaintext, err := open(aead, kv, data[checksumSize:hdrSize])
+		if err != nil {
+			return Record{}, err
+		}
+		kv = plaintext
+	}
+
+	return Record{
+		Header: header,
+		Key:    string(kv[:header.KeySize]),
+		Value:  kv[header.KeySize:],
+	}, nil
+}
+
+// encode writes the header, key and value to the buffer. The checksum is computed
+// over the encoded record and set in the header. If a cipher is given, the key and
+// value are encrypted.
+func (r *Record) encode(buf *bytes.Buffer, aead cipher.AEAD) error {
+	start := buf.Len()
+
+	r.Header.Checksum = 0
+	if err := r.Header.encode(buf); err != nil {
+		return err
+	}
+
+	if aead == nil {
+		buf.WriteString(r.Key)
+		buf.Write(r.Value)
+	} else {
+		plaintext := make([]byte, 0, len(r.Key)+len(r.Value))
+		plaintext = append(plaintext, r.Key...)
+		plaintext = append(plaintext, r.Value...)
+
+		sealed, err := seal(aead, nil, plaintext, buf.Bytes()[start+checksumSize:])
+		if err != nil {
+			return err
+		}
+		buf.Write(sealed)
+	}
+
+	// Compute the checksum over everything following it and fill it in the header.
+	data := buf.Bytes()[start:]
+	r.Header.Checksum = crc32.Checksum(data[checksumSize:], crcTable)
+	binary.LittleEndian.PutUint32(data, r.Header.Checksum)
+
+	return nil
 }
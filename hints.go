@@ -0,0 +1,397 @@
+package barrel
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
+)
+
+// hint represents the latest record for a key in a datafile.
+// Each datafile has a hints file which contains a hint for every key present
+// in it. This allows building the keydir on startup without reading the datafiles.
+type hint struct {
+	Key       string
+	Meta      Meta
+	Tombstone bool
+}
+
+// hintsHeader is written at the start of the hints file.
+type hintsHeader struct {
+	Created int64 // Creation time of the datafile from its file header.
+	Offset  int   // Position in the datafile up to which the hints are valid.
+}
+
+// hintsPath returns the path of the hints file for the given datafile ID.
+func hintsPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf(HINTS_FILE, id))
+}
+
+/*
+The hints file is encoded in a compact binary format which can be written
+and read incrementally, without holding all the hints in memory at once.
+
+Representation of the hints file.
+-------------------------------------------------------------------------
+| magic(4) | version(2) | flags(2) | created(8) | offset(8) |           |
+-------------------------------------------------------------------------
+| flags(1) | time(8) | expiry(8) | record_size(8) | record_pos(8) |     |
+| key_size(4) | key                                    ... per hint     |
+-------------------------------------------------------------------------
+| crc(4)                                                                |
+-------------------------------------------------------------------------
+
+The trailing CRC32C checksum covers all the bytes before it.
+
+Hints files for encrypted datafiles are encrypted with the same key. The hints
+following the header are sealed in chunks with AES-GCM (see sealWriter), so the
+keys aren't exposed. The header is left in plaintext.
+*/
+const (
+	hintsMagic      = "BRLH"
+	hintsVersion    = 3
+	hintsHeaderSize = 24
+	hintEntrySize   = 37
+)
+
+// Flags stored for every hint.
+const (
+	hintTombstone uint8 = 1 << iota
+)
+
+// Flags stored in the header of the hints file.
+const (
+	hintsEncrypted uint16 = 1 << iota
+)
+
+// hintsWriter writes the hints incrementally to a temporary file.
+// The temporary file is atomically renamed to the hints file on Close,
+// so a crash while writing never leaves behind a truncated hints file.
+type hintsWriter struct {
+	path string
+	file *os.File
+	out  *bufio.Writer
+	w    io.Writer // Writer for the hints, which encrypts them if required.
+	seal *sealWriter
+	crc  hash.Hash32
+	buf  [hintEntrySize]byte
+}
+
+// newHintsWriter creates a temporary file for the hints file at the given path and writes the header.
+// If a cipher is given, the hints are encrypted with it.
+func newHintsWriter(path string, hdr hintsHeader, aead cipher.AEAD) (*hintsWriter, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	hw := &hintsWriter{
+		path: path,
+		file: file,
+		crc:  crc32.New(crcTable),
+	}
+	hw.out = bufio.NewWriter(io.MultiWriter(file, hw.crc))
+	hw.w = hw.out
+
+	var flags uint16
+	if aead != nil {
+		flags |= hintsEncrypted
+		hw.seal = newSealWriter(hw.out, aead)
+		hw.w = hw.seal
+	}
+
+	var b [hintsHeaderSize]byte
+	copy(b[0:], hintsMagic)
+	binary.LittleEndian.PutUint16(b[4:], hintsVersion)
+	binary.LittleEndian.PutUint16(b[6:], flags)
+	binary.LittleEndian.PutUint64(b[8:], uint64(hdr.Created))
+	binary.LittleEndian.PutUint64(b[16:], uint64(hdr.Offset))
+
+	if _, err := hw.out.Write(b[:]); err != nil {
+		hw.Abort()
+		return nil, err
+	}
+
+	return hw, nil
+}
+
+// Write appends a hint to the hints file.
+func (hw *hintsWriter) Write(h hint) error {
+	var flags uint8
+	if h.Tombstone {
+		flags |= hintTombstone
+	}
+
+	b := hw.buf[:]
+	b[0] = flags
+	binary.LittleEndian.PutUint64(b[1:], uint64(h.Meta.Timestamp))
+	binary.LittleEndian.PutUint64(b[9:], uint64(h.Meta.Expiry))
+	binary.LittleEndian.PutUint64(b[17:], uint64(h.Meta.RecordSize))
+	binary.LittleEndian.PutUint64(b[25:], uint64(h.Meta.RecordPos))
+	binary.LittleEndian.PutUint32(b[33:], uint32(len(h.Key)))
+
+	if _, err := hw.w.Write(b); err != nil {
+		return err
+	}
+	_, err := io.WriteString(hw.w, h.Key)
+	return err
+}
+
+// Close writes the checksum, flushes the temporary file to disk
+// and renames it to the hints file.
+func (hw *hintsWriter) Close() error {
+	if hw.seal != nil {
+		if err := hw.seal.Close(); err != nil {
+			hw.Abort()
+			return err
+		}
+	}
+	if err := hw.out.Flush(); err != nil {
+		hw.Abort()
+		return err
+	}
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], hw.crc.Sum32())
+	if _, err := hw.file.Write(b[:]); err != nil {
+		hw.Abort()
+		return err
+	}
+
+	if err := hw.file.Sync(); err != nil {
+		hw.Abort()
+		return err
+	}
+	if err := hw.file.Close(); err != nil {
+		os.Remove(hw.file.Name())
+		return err
+	}
+
+	if err := os.Rename(hw.file.Name(), hw.path); err != nil {
+		os.Remove(hw.file.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(hw.path))
+}
+
+// Abort discards the temporary file.
+func (hw *hintsWriter) Abort() {
+	hw.file.Close()
+	os.Remove(hw.file.Name())
+}
+
+// writeHints writes all the hints to the hints file.
+func writeHints(path string, hdr hintsHeader, hints []hint, aead cipher.AEAD) error {
+	hw, err := newHintsWriter(path, hdr, aead)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hints {
+		if err := hw.Write(h); err != nil {
+			hw.Abort()
+			return err
+		}
+	}
+
+	return hw.Close()
+}
+
+// readHints reads the hints file incrementally and calls fn for each hint.
+// The hints should only be used if no error is returned, since the checksum
+// is verified after reading all the hints. Encrypted hints are decrypted with the given cipher.
+func readHints(path string, id int, aead cipher.AEAD, fn func(h hint) error) (hintsHeader, error) {
+	var hdr hintsHeader
+
+	file, err := os.Open(path)
+	if err != nil {
+		return hdr, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return hdr, err
+	}
+	if stat.Size() < hintsHeaderSize+crc32.Size {
+		return hdr, errInvalidHints
+	}
+
+	var (
+		crc = crc32.New(crcTable)
+		// Read everything except the trailing checksum while computing the checksum.
+		r = bufio.NewReader(io.TeeReader(io.LimitReader(file, stat.Size()-crc32.Size), crc))
+		b [hintEntrySize]byte
+	)
+
+	if _, err := io.ReadFull(r, b[:hintsHeaderSize]); err != nil {
+		return hdr, err
+	}
+	if string(b[0:4]) != hintsMagic || binary.LittleEndian.Uint16(b[4:]) != hintsVersion {
+		return hdr, errInvalidHints
+	}
+	hdr.Created = int64(binary.LittleEndian.Uint64(b[8:]))
+	hdr.Offset = int(binary.LittleEndian.Uint64(b[16:]))
+
+	// The hints must be encrypted if and only if the datafile is encrypted.
+	encrypted := binary.LittleEndian.Uint16(b[6:])&hintsEncrypted != 0
+	if encrypted != (aead != nil) {
+		return hdr, fmt.Errorf("%w: encryption does not match the datafile", errInvalidHints)
+	}
+	if encrypted {
+		r = bufio.NewReader(newOpenReader(r, aead))
+	}
+
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return hdr, errInvalidHints
+		}
+
+		h := hint{
+			Meta: Meta{
+				Timestamp:  int(binary.LittleEndian.Uint64(b[1:])),
+				Expiry:     int(binary.LittleEndian.Uint64(b[9:])),
+				RecordSize: int(binary.LittleEndian.Uint64(b[17:])),
+				RecordPos:  int(binary.LittleEndian.Uint64(b[25:])),
+				FileID:     id,
+			},
+			Tombstone: b[0]&hintTombstone != 0,
+		}
+
+		keySize := int64(binary.LittleEndian.Uint32(b[33:]))
+		if keySize > stat.Size() {
+			return hdr, errInvalidHints
+		}
+
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return hdr, errInvalidHints
+		}
+		h.Key = string(key)
+
+		if err := fn(h); err != nil {
+			return hdr, err
+		}
+	}
+
+	// Verify the trailing checksum.
+	var sum [crc32.Size]byte
+	if _, err := io.ReadFull(file, sum[:]); err != nil {
+		return hdr, err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != crc.Sum32() {
+		return hdr, fmt.Errorf("%w: checksum does not match", errInvalidHints)
+	}
+
+	return hdr, nil
+}
+
+// buildHints scans the datafile starting from the given offset and adds a hint
+// for the latest record of every key to the existing hints.
+// It returns the hints along with the position up to which the datafile was read.
+func buildHints(df *datafile.DataFile, offset int, hints []hint) ([]hint, int, error) {
+	// Index of the hint for every key, to keep only the latest record for the key.
+	index := make(map[string]int, len(hints))
+	for i, h := range hints {
+		index[h.Key] = i
+	}
+
+	pos, err := scan(df, offset, func(record Record, pos int, size int) error {
+		h := hint{
+			Key: record.Key,
+			Meta: Meta{
+				Timestamp:  int(record.Header.Timestamp),
+				Expiry:     int(record.Header.Expiry),
+				RecordSize: size,
+				RecordPos:  pos,
+				FileID:     df.ID(),
+			},
+			Tombstone: record.isTombstone(),
+		}
+
+		if i, ok := index[h.Key]; ok {
+			hints[i] = h
+		} else {
+			index[h.Key] = len(hints)
+			hints = append(hints, h)
+		}
+		return nil
+	})
+
+	return hints, pos, err
+}
+
+// generateHints scans the complete datafile and writes the hints file for it.
+// It's called once the datafile is sealed and no more records are written to it.
+func (b *Barrel) generateHints(df *datafile.DataFile) error {
+	hints, pos, err := buildHints(df, df.Start(), nil)
+	if err != nil {
+		return err
+	}
+
+	return b.saveHints(df, pos, hints)
+}
+
+// saveHints writes the hints which are valid up to the given offset in the datafile.
+func (b *Barrel) saveHints(df *datafile.DataFile, offset int, hints []hint) error {
+	hdr := hintsHeader{
+		Created: df.Header().Created,
+		Offset:  offset,
+	}
+
+	return writeHints(hintsPath(b.opts.dir, df.ID()), hdr, hints, df.Cipher())
+}
+
+// fileHints holds the hints for a datafile loaded during startup.
+type fileHints struct {
+	hints   []hint
+	offset  int  // Position in the datafile up to which the hints are valid.
+	scanned bool // Whether the datafile had to be scanned because the hints file was missing or stale.
+	err     error
+}
+
+// loadHints loads the hints for the datafile from its hints file. If the hints file is missing
+// or doesn't cover the complete datafile, the remaining records are scanned from the datafile.
+func (b *Barrel) loadHints(df *datafile.DataFile) fileHints {
+	res := fileHints{offset: df.Start()}
+
+	size, err := df.Size()
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	path := hintsPath(b.opts.dir, df.ID())
+	if exists(path) {
+		var hints []hint
+		hdr, err := readHints(path, df.ID(), df.Cipher(), func(h hint) error {
+			hints = append(hints, h)
+			return nil
+		})
+		if err == nil && hdr.Created == df.Header().Created && int64(hdr.Offset) <= size {
+			res.hints, res.offset = hints, hdr.Offset
+		} else {
+			b.lo.Error("hints file is stale, scanning datafile", "id", df.ID(), "error", err)
+		}
+	}
+
+	// Scan the records written after the hints file was generated.
+	if int64(res.offset) < size {
+		res.scanned = true
+		res.hints, res.offset, res.err = buildHints(df, res.offset, res.hints)
+	}
+
+	return res
+}
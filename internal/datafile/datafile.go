@@ -1,29 +1,113 @@
 package datafile
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
 	ACTIVE_DATAFILE = "barrel_%d.db"
+
+	// Magic bytes present at the start of every datafile.
+	Magic = "BRL1"
+	// HeaderSize is the size in bytes of the file header.
+	HeaderSize = 32
 )
 
+// Format versions of the datafile. The version decides the layout of the records.
+const (
+	// VersionLegacy represents datafiles written before the file header was introduced.
+	VersionLegacy = 1
+	// Version2 adds the file header.
+	Version2 = 2
+	// Version3 adds a flags field to the record header.
+	Version3 = 3
+	// Version4 stores the timestamp and expiry of records as 64 bit milliseconds.
+	Version4 = 4
+
+	// CurrentVersion is the version used for all newly created datafiles.
+	CurrentVersion = Version4
+)
+
+// Flags stored in the file header.
+const (
+	// FlagEncrypted marks that all the records in the file are encrypted.
+	FlagEncrypted uint16 = 1 << iota
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported datafile format version")
+)
+
+/*
+FileHeader is written at the start of every datafile.
+
+----------------------------------------------------------------------------
+| magic(4) | version(2) | flags(2) | created(8) | key_id(4) | reserved(12) |
+----------------------------------------------------------------------------
+*/
+type FileHeader struct {
+	Magic    [4]byte
+	Version  uint16
+	Flags    uint16   // Codec flags applicable to all the records in the file.
+	Created  int64    // Unix timestamp (in seconds) of when the datafile was created.
+	KeyID    uint32   // ID of the key used for encrypting the records, if FlagEncrypted is set.
+	Reserved [12]byte // Reserved for future use. Must be zero.
+}
+
 type DataFile struct {
 	sync.RWMutex
 
 	writer *os.File
 	reader *os.File
 	id     int
+	header FileHeader
+	cipher cipher.AEAD // Cipher for encrypting/decrypting the records.
+	group  groupSync   // Shares fsync calls between concurrent writers.
 
 	offset int
 }
 
+// groupSync tracks the position up to which the datafile is synced to disk,
+// so that concurrent writers can wait on a single fsync call.
+type groupSync struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool  // Whether a fsync call is in progress.
+	pending int   // Position up to which writers are waiting for the data to be synced.
+	synced  int   // Position up to which the data is synced to disk.
+	failed  int   // Position up to which the last failed fsync call was syncing.
+	err     error // Error returned by the last failed fsync call.
+
+	fsync func() error // Syncs the datafile to disk.
+}
+
+// Option configures a newly created datafile.
+type Option func(*DataFile)
+
+// WithEncryption encrypts the records of a newly created datafile with the given cipher.
+// The key ID is stored in the file header to find the key while reading the file later.
+func WithEncryption(keyID uint32, aead cipher.AEAD) Option {
+	return func(d *DataFile) {
+		d.header.Flags |= FlagEncrypted
+		d.header.KeyID = keyID
+		d.cipher = aead
+	}
+}
+
 // New initialises a db store for storing/reading an active db file.
 // At a given time only one file can be active.
-func New(dir string, index int) (*DataFile, error) {
+// A file header is written to newly created files. For existing files, the
+// header is read to determine the format version of the records and the options are ignored.
+func New(dir string, index int, opts ...Option) (*DataFile, error) {
 	// If the file doesn't exist, create it, or append to the file.
 	path := filepath.Join(dir, fmt.Sprintf(ACTIVE_DATAFILE, index))
 	writer, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -37,20 +121,92 @@ func New(dir string, index int) (*DataFile, error) {
 		return nil, fmt.Errorf("error opening file for reading db: %w", err)
 	}
 
+	df := &DataFile{
+		writer: writer,
+		reader: reader,
+		id:     index,
+	}
+
+	df.group.cond = sync.NewCond(&df.group.mu)
+	df.group.fsync = writer.Sync
+
+	if err := df.loadHeader(opts); err != nil {
+		df.Close()
+		return nil, fmt.Errorf("error loading header for %s: %w", path, err)
+	}
+
 	// Get the offset for the current file.
 	stat, err := writer.Stat()
 	if err != nil {
 		return nil, fmt.Errorf("error fetching file stats: %v", err)
 	}
+	df.offset = int(stat.Size())
 
-	df := &DataFile{
-		writer: writer,
-		reader: reader,
-		id:     index,
-		offset: int(stat.Size()),
+	return df, nil
+}
+
+// loadHeader reads the file header. If the file is empty or only has
+// a partially written header, a new header is written.
+// Files which don't start with the magic bytes are considered as legacy files.
+func (d *DataFile) loadHeader(opts []Option) error {
+	buf := make([]byte, HeaderSize)
+	n, err := d.reader.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
 	}
 
-	return df, nil
+	// An empty file or a partially written header left behind by a crash while creating the file.
+	prefix := buf[:n]
+	if len(prefix) > len(Magic) {
+		prefix = prefix[:len(Magic)]
+	}
+	if n < HeaderSize && bytes.HasPrefix([]byte(Magic), prefix) {
+		if err := d.writer.Truncate(0); err != nil {
+			return err
+		}
+		return d.writeHeader(opts)
+	}
+
+	// Legacy datafiles don't have a file header.
+	if !bytes.HasPrefix(buf, []byte(Magic)) {
+		d.header = FileHeader{Version: VersionLegacy}
+		return nil
+	}
+
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &d.header); err != nil {
+		return err
+	}
+
+	// The file header was introduced in Version2, so older versions can't have one.
+	if d.header.Version < Version2 || d.header.Version > CurrentVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, d.header.Version)
+	}
+
+	return nil
+}
+
+// writeHeader writes a new file header for the current version.
+func (d *DataFile) writeHeader(opts []Option) error {
+	d.header = FileHeader{
+		Version: CurrentVersion,
+		Created: time.Now().Unix(),
+	}
+	copy(d.header.Magic[:], Magic)
+
+	for _, o := range opts {
+		o(d)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, HeaderSize))
+	if err := binary.Write(buf, binary.LittleEndian, d.header); err != nil {
+		return err
+	}
+
+	if _, err := d.writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // ID returns the ID of the datafile.
@@ -58,6 +214,40 @@ func (d *DataFile) ID() int {
 	return d.id
 }
 
+// Version returns the format version of the datafile.
+func (d *DataFile) Version() int {
+	return int(d.header.Version)
+}
+
+// Header returns the file header of the datafile.
+func (d *DataFile) Header() FileHeader {
+	return d.header
+}
+
+// Encrypted returns true if the records in the datafile are encrypted.
+func (d *DataFile) Encrypted() bool {
+	return d.header.Flags&FlagEncrypted != 0
+}
+
+// Cipher returns the cipher for encrypting and decrypting the records.
+// It's nil if the datafile isn't encrypted.
+func (d *DataFile) Cipher() cipher.AEAD {
+	return d.cipher
+}
+
+// SetCipher sets the cipher for an existing encrypted datafile.
+func (d *DataFile) SetCipher(aead cipher.AEAD) {
+	d.cipher = aead
+}
+
+// Start returns the offset of the first record in the datafile.
+func (d *DataFile) Start() int {
+	if d.header.Version == VersionLegacy {
+		return 0
+	}
+	return HeaderSize
+}
+
 // Size returns the size of DB file in bytes.
 func (d *DataFile) Size() (int64, error) {
 	// Use stat to get file syze in bytes.
@@ -74,6 +264,51 @@ func (d *DataFile) Sync() error {
 	return d.writer.Sync()
 }
 
+// SyncTo waits until the data written up to the given position is synced to disk.
+// If no fsync call is in progress, the caller issues one for all the data written so far.
+// Otherwise it waits for the ongoing call to finish, so that the writers waiting at
+// the same time share a single fsync call.
+func (d *DataFile) SyncTo(pos int) error {
+	g := &d.group
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if pos > g.pending {
+		g.pending = pos
+	}
+
+	for g.synced < pos {
+		// The data of the caller was written before the failed fsync call was issued.
+		if g.err != nil && pos <= g.failed {
+			return g.err
+		}
+
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		// Become the leader and sync the data of all the waiting writers.
+		g.syncing = true
+		target := g.pending
+		g.mu.Unlock()
+
+		err := g.fsync()
+
+		g.mu.Lock()
+		g.syncing = false
+		if err != nil {
+			g.err, g.failed = err, target
+		} else if target > g.synced {
+			g.synced = target
+		}
+		g.cond.Broadcast()
+	}
+
+	return nil
+}
+
 func (d *DataFile) Read(pos int, size int) ([]byte, error) {
 	// Byte position to read the file from.
 	start := int64(pos - size)
@@ -95,6 +330,17 @@ func (d *DataFile) Read(pos int, size int) ([]byte, error) {
 	return record, nil
 }
 
+// Reader returns a reader which sequentially reads the file
+// starting from the given offset until the current end of file.
+func (d *DataFile) Reader(offset int) (io.Reader, error) {
+	size, err := d.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NewSectionReader(d.reader, int64(offset), size-int64(offset)), nil
+}
+
 // Write writes the record to the underlying db file.
 func (d *DataFile) Write(data []byte) (int, error) {
 	if _, err := d.writer.Write(data); err != nil {
@@ -110,6 +356,18 @@ func (d *DataFile) Write(data []byte) (int, error) {
 	return offset, nil
 }
 
+// Truncate discards all the data in the file after the given size
+// and moves the write offset back to that position.
+func (d *DataFile) Truncate(size int) error {
+	if err := d.writer.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	d.offset = size
+
+	return d.writer.Sync()
+}
+
 // Close closes the file descriptors of the underlying db file.
 func (d *DataFile) Close() error {
 	if err := d.writer.Close(); err != nil {
@@ -0,0 +1,101 @@
+package datafile
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncTo(t *testing.T) {
+	assert := assert.New(t)
+
+	df, err := New(t.TempDir(), 0)
+	assert.NoError(err)
+	defer df.Close()
+
+	var (
+		mu      sync.Mutex
+		calls   int
+		durable int64 // Position up to which the data is synced by the fsync calls.
+
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	// The first fsync call blocks until it's released, so the other writers pile up behind it.
+	df.group.fsync = func() error {
+		size, err := df.Size()
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+
+		if first {
+			close(started)
+			<-release
+		}
+
+		mu.Lock()
+		durable = size
+		mu.Unlock()
+		return nil
+	}
+
+	// syncTo syncs the data up to pos and checks that it's durable once SyncTo returns.
+	var wg sync.WaitGroup
+	syncTo := func(pos int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(df.SyncTo(pos))
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.GreaterOrEqual(durable, int64(pos))
+		}()
+	}
+
+	write := func() int {
+		offset, err := df.Write([]byte("record"))
+		assert.NoError(err)
+		return offset + len("record")
+	}
+
+	// The first writer issues a fsync call which blocks.
+	syncTo(write())
+	<-started
+
+	// The writers arriving during the fsync call wait for it to finish. Each writer is only
+	// started once the previous one is waiting, which is when its position is pending.
+	for i := 0; i < 8; i++ {
+		pos := write()
+		syncTo(pos)
+		for {
+			df.group.mu.Lock()
+			pending := df.group.pending
+			df.group.mu.Unlock()
+			if pending == pos {
+				break
+			}
+		}
+	}
+
+	// None of the waiting writers return before their data is synced.
+	mu.Lock()
+	assert.Zero(durable)
+	mu.Unlock()
+
+	// All the waiting writers share a single fsync call once the first one is done.
+	close(release)
+	wg.Wait()
+	assert.Equal(2, calls)
+
+	// Data which is already synced doesn't need another fsync call.
+	assert.NoError(df.SyncTo(int(durable)))
+	assert.Equal(2, calls)
+}
@@ -0,0 +1,345 @@
+package barrel
+
+import (
+	"sort"
+
+	"github.com/tidwall/btree"
+)
+
+// IteratorOption configures the order in which an Iterator visits the keys.
+type IteratorOption func(*iteratorOptions)
+
+type iteratorOptions struct {
+	diskOrder bool
+	reverse   bool
+	keysOnly  bool
+
+	// Bounds of the keys to visit in the ordered index. The start is inclusive,
+	// the end is exclusive and an empty end means there's no upper bound.
+	ranged     bool
+	start, end string
+}
+
+// InDiskOrder visits the records in the order they're stored on disk, i.e. by the
+// datafile ID and the position in the datafile. This turns a full scan into sequential
+// reads, at the cost of sorting the keys of the complete snapshot before iterating.
+// The keys of a range are picked from the complete snapshot as well, so they don't need
+// the ordered index. It can't be combined with Reverse.
+func InDiskOrder() IteratorOption {
+	return func(o *iteratorOptions) {
+		o.diskOrder = true
+	}
+}
+
+// Reverse visits the keys in descending order. It requires the ordered index.
+func Reverse() IteratorOption {
+	return func(o *iteratorOptions) {
+		o.reverse = true
+	}
+}
+
+// KeysOnly skips reading the values of the keys, so no disk reads are done while iterating.
+// Value returns nil for every key.
+func KeysOnly() IteratorOption {
+	return func(o *iteratorOptions) {
+		o.keysOnly = true
+	}
+}
+
+// withRange visits the keys in [start, end).
+func withRange(start, end string) IteratorOption {
+	return func(o *iteratorOptions) {
+		o.ranged = true
+		o.start, o.end = start, end
+	}
+}
+
+// Iterator iterates over the live keys and their values in a snapshot.
+// Expired keys are skipped. If the ordered index is enabled, the keys are visited
+// in sorted order. Otherwise they're visited in no particular order.
+//
+//	it := brl.NewIterator()
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), string(it.Value()))
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	snap    *Snapshot
+	release bool // Whether the snapshot is owned by the iterator and released on Close.
+
+	opts    iteratorOptions
+	entries []entry // Pending keys to visit.
+	shard   int     // Index of the next shard to load the keys from.
+
+	// Iterator over the ordered index, which is used instead of the shards if set.
+	ordered bool
+	iter    btree.SetIter[string]
+	started bool
+	done    bool
+
+	key   string
+	meta  Meta
+	value []byte
+	err   error
+}
+
+// entry is a key along with its metadata in the snapshot.
+type entry struct {
+	key  string
+	meta Meta
+}
+
+// NewIterator returns an iterator over a new snapshot of the datastore.
+// Close must be called to release the snapshot once the iteration is done.
+func (b *Barrel) NewIterator(opts ...IteratorOption) *Iterator {
+	it := b.Snapshot().NewIterator(opts...)
+	it.release = true
+	return it
+}
+
+// NewIterator returns an iterator over the snapshot.
+func (s *Snapshot) NewIterator(opts ...IteratorOption) *Iterator {
+	it := &Iterator{snap: s}
+	for _, o := range opts {
+		o(&it.opts)
+	}
+
+	if s.shards == nil {
+		it.err = ErrSnapshotReleased
+		return it
+	}
+
+	if it.opts.diskOrder && it.opts.reverse {
+		it.err = ErrReverseDiskOrder
+		return it
+	}
+
+	if s.index != nil && !it.opts.diskOrder {
+		it.ordered = true
+		it.iter = s.index.Iter()
+		return it
+	}
+
+	// Ranges and reverse iteration are only possible with the ordered index,
+	// unless all the keys are loaded for visiting them in disk order.
+	if (it.opts.ranged && !it.opts.diskOrder) || it.opts.reverse {
+		it.err = ErrNoIndex
+		return it
+	}
+
+	// Records can only be visited in disk order once all the keys are sorted.
+	if it.opts.diskOrder {
+		for it.shard < len(s.shards) {
+			it.load()
+		}
+		if it.opts.ranged {
+			entries := it.entries[:0]
+			for _, e := range it.entries {
+				if e.key >= it.opts.start && (it.opts.end == "" || e.key < it.opts.end) {
+					entries = append(entries, e)
+				}
+			}
+			it.entries = entries
+		}
+		sort.Slice(it.entries, func(i, j int) bool {
+			a, b := it.entries[i].meta, it.entries[j].meta
+			if a.FileID != b.FileID {
+				return a.FileID < b.FileID
+			}
+			return a.RecordPos < b.RecordPos
+		})
+	}
+
+	return it
+}
+
+// load adds the keys of the next shard to the pending keys.
+func (it *Iterator) load() {
+	it.snap.shards[it.shard].Scan(func(k string, meta Meta) bool {
+		it.entries = append(it.entries, entry{key: k, meta: meta})
+		return true
+	})
+	it.shard++
+}
+
+// Next moves the iterator to the next key and reads its value.
+// It returns false once all the keys are visited or if an error occurs.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for {
+		e, ok := it.next()
+		if !ok {
+			return false
+		}
+
+		// Skip the keys which have expired since the snapshot was taken.
+		if e.meta.isExpired() {
+			continue
+		}
+
+		var value []byte
+		if !it.opts.keysOnly {
+			v, err := it.snap.read(e.key, e.meta)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			value = v
+		}
+
+		it.key, it.meta, it.value = e.key, e.meta, value
+		return true
+	}
+}
+
+// next returns the next key to visit.
+func (it *Iterator) next() (entry, bool) {
+	if it.ordered {
+		return it.nextOrdered()
+	}
+
+	// Load the keys of the next shard once the current one is done.
+	for len(it.entries) == 0 {
+		if it.shard >= len(it.snap.shards) {
+			return entry{}, false
+		}
+		it.load()
+	}
+
+	e := it.entries[0]
+	it.entries = it.entries[1:]
+	return e, true
+}
+
+// nextOrdered returns the next key in the ordered index within the bounds.
+func (it *Iterator) nextOrdered() (entry, bool) {
+	if it.done {
+		return entry{}, false
+	}
+
+	var ok bool
+	switch {
+	case it.started && it.opts.reverse:
+		ok = it.iter.Prev()
+	case it.started:
+		ok = it.iter.Next()
+	default:
+		it.started = true
+		ok = it.seek()
+	}
+
+	if ok {
+		k := it.iter.Key()
+		if it.opts.reverse {
+			ok = k >= it.opts.start
+		} else {
+			ok = it.opts.end == "" || k < it.opts.end
+		}
+	}
+	if !ok {
+		it.done = true
+		return entry{}, false
+	}
+
+	k := it.iter.Key()
+	meta, _ := it.snap.shards[it.snap.keydir.shardIndex(k)].Get(k)
+	return entry{key: k, meta: meta}, true
+}
+
+// seek moves the iterator over the ordered index to the first key to visit.
+func (it *Iterator) seek() bool {
+	if !it.opts.reverse {
+		if it.opts.start == "" {
+			return it.iter.First()
+		}
+		return it.iter.Seek(it.opts.start)
+	}
+
+	// Move to the last key before the end.
+	if it.opts.end == "" || !it.iter.Seek(it.opts.end) {
+		return it.iter.Last()
+	}
+	return it.iter.Prev()
+}
+
+// Key returns the key at the current position of the iterator.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the key at the current position of the iterator.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Meta returns the metadata of the key at the current position of the iterator.
+func (it *Iterator) Meta() Meta {
+	return it.meta
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close stops the iteration and releases the snapshot if it was created by the iterator.
+func (it *Iterator) Close() error {
+	it.entries = nil
+	it.shard = len(it.snap.shards)
+	it.done = true
+	if it.release {
+		it.release = false
+		return it.snap.Release()
+	}
+	return nil
+}
+
+// Scan returns an iterator over the keys with the given prefix in sorted order.
+// It requires the ordered index to be enabled with WithOrderedIndex, unless the
+// keys are visited InDiskOrder.
+func (b *Barrel) Scan(prefix string, opts ...IteratorOption) *Iterator {
+	return b.Range(prefix, prefixEnd(prefix), opts...)
+}
+
+// Range returns an iterator over the keys which are greater than or equal to start
+// and less than end in sorted order. An empty end iterates till the last key.
+// It requires the ordered index to be enabled with WithOrderedIndex, unless the
+// keys are visited InDiskOrder.
+func (b *Barrel) Range(start, end string, opts ...IteratorOption) *Iterator {
+	return b.NewIterator(append(opts, withRange(start, end))...)
+}
+
+// prefixEnd returns the smallest key which is greater than all the keys with the
+// given prefix. It's empty if there's no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// FoldKV iterates over all the live keys and calls the given function for each key and its value.
+// Expired keys are skipped. The keys are iterated over a snapshot, so writes made
+// while iterating aren't visible and fn can write to the datastore.
+func (b *Barrel) FoldKV(fn func(k string, v []byte) error, opts ...IteratorOption) error {
+	it := b.NewIterator(opts...)
+	defer it.Close()
+
+	for it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
@@ -1,8 +1,12 @@
 package barrel
 
 import (
-	"encoding/gob"
-	"os"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/btree"
 )
 
 // KeyDir represents an in-memory hash for faster lookups of the key.
@@ -10,57 +14,341 @@ import (
 // and the file ID is used to extract the underlying record from the disk.
 // Advantage is that this approach only requires a single disk seek of the db file
 // since the position offset (in bytes) is already stored.
-type KeyDir map[string]Meta
+//
+// The keys are partitioned into shards by their hash and each shard has its own lock,
+// so that writes to keys in different shards don't contend with each other.
+// Every shard stores its keys in a copy-on-write B-tree, so a snapshot shares the
+// B-trees with the keydir and a write after it only copies the nodes it modifies.
+//
+// Optionally, the keys are also stored in a B-tree which keeps them sorted for
+// prefix and range scans. The B-tree has a single lock, so adding and removing keys
+// contend on it, whereas updating the value of an existing key doesn't touch it.
+type KeyDir struct {
+	seed   maphash.Seed
+	shards []*shard
+	stats  fileStats // Number of live bytes in every datafile.
+
+	indexMu sync.RWMutex
+	index   *btree.Set[string] // Ordered index of all the keys. nil if it's disabled.
+}
+
+// shard holds a partition of the keys in the KeyDir.
+type shard struct {
+	sync.RWMutex
+	keys *btree.Map[string, Meta]
+}
 
 // Meta represents some additional properties for the given key.
 // The actual value of the key is not stored in the in-memory hashtable.
 type Meta struct {
-	Timestamp  int
+	Timestamp  int // Unix timestamp in milliseconds when the record was written.
+	Expiry     int // Unix timestamp in milliseconds after which the key is expired. 0 if no expiry is set.
 	RecordSize int
 	RecordPos  int
 	FileID     int
 }
 
-// Encode encodes the map to a gob file.
-// This is typically used to generate a hints file.
-// Caller of this program should ensure to lock/unlock the map before calling.
-func (k *KeyDir) Encode(fPath string) error {
-	// Create a file for storing gob data.
-	file, err := os.Create(fPath)
-	if err != nil {
-		return err
+// isExpired returns true if the key has already expired.
+func (m Meta) isExpired() bool {
+	return isExpired(int64(m.Expiry))
+}
+
+// newKeyDir creates an empty KeyDir with the given number of shards.
+func newKeyDir(shards int, ordered bool) *KeyDir {
+	kd := &KeyDir{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*shard, shards),
+		stats:  fileStats{live: make(map[int]*atomic.Int64), tombstones: make(map[int]int64)},
+	}
+	if ordered {
+		kd.index = &btree.Set[string]{}
+	}
+	for i := range kd.shards {
+		kd.shards[i] = &shard{keys: &btree.Map[string, Meta]{}}
+	}
+	return kd
+}
+
+// shard returns the shard which holds the given key.
+func (kd *KeyDir) shard(k string) *shard {
+	return kd.shards[kd.shardIndex(k)]
+}
+
+// shardIndex returns the index of the shard which holds the given key.
+func (kd *KeyDir) shardIndex(k string) int {
+	return int(maphash.String(kd.seed, k) % uint64(len(kd.shards)))
+}
+
+// lockShards locks the shards which hold the given keys for writing.
+// The shards are locked in the order of their index to avoid deadlocks.
+// It returns a function which unlocks all of them.
+func (kd *KeyDir) lockShards(keys []string) func() {
+	idx := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, k := range keys {
+		i := kd.shardIndex(k)
+		if !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+
+	for _, i := range idx {
+		kd.shards[i].Lock()
+	}
+
+	return func() {
+		for _, i := range idx {
+			kd.shards[i].Unlock()
+		}
+	}
+}
+
+// Get returns the metadata for the key.
+func (kd *KeyDir) Get(k string) (Meta, bool) {
+	s := kd.shard(k)
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.keys.Get(k)
+}
+
+// Set stores the metadata for the key.
+func (kd *KeyDir) Set(k string, meta Meta) {
+	s := kd.shard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	kd.put(s, k, meta)
+}
+
+// Delete removes the key.
+func (kd *KeyDir) Delete(k string) {
+	s := kd.shard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	kd.remove(s, k)
+}
+
+// put stores the metadata for the key in the shard and adds new keys to the ordered index.
+// It's called with the shard locked.
+func (kd *KeyDir) put(s *shard, k string, meta Meta) {
+	old, ok := s.keys.Set(k, meta)
+	if ok {
+		kd.stats.add(old.FileID, -old.RecordSize)
+	} else if kd.index != nil {
+		kd.indexMu.Lock()
+		kd.index.Insert(k)
+		kd.indexMu.Unlock()
 	}
-	defer file.Close()
+	kd.stats.add(meta.FileID, meta.RecordSize)
+}
 
-	// Create a new gob encoder.
-	encoder := gob.NewEncoder(file)
+// remove removes the key from the shard and the ordered index.
+// It's called with the shard locked.
+func (kd *KeyDir) remove(s *shard, k string) {
+	old, ok := s.keys.Delete(k)
+	if !ok {
+		return
+	}
+	kd.stats.add(old.FileID, -old.RecordSize)
+	if kd.index != nil {
+		kd.indexMu.Lock()
+		kd.index.Delete(k)
+		kd.indexMu.Unlock()
+	}
+}
 
-	// Encode the map and save it to the file.
-	err = encoder.Encode(k)
-	if err != nil {
-		return err
+// swap replaces the metadata of the key only if it's still the given old metadata.
+// An empty new metadata removes the key. It returns true if the key was replaced.
+func (kd *KeyDir) swap(k string, old, meta Meta) bool {
+	s := kd.shard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	if cur, ok := s.keys.Get(k); !ok || cur != old {
+		return false
 	}
 
-	return nil
+	if meta == (Meta{}) {
+		kd.remove(s, k)
+	} else {
+		kd.put(s, k, meta)
+	}
+	return true
 }
 
-// Decode decodes the gob data in the map.
-func (k *KeyDir) Decode(fPath string) error {
-	// Open the file for decoding gob data.
-	file, err := os.Open(fPath)
-	if err != nil {
-		return err
+// Len returns the number of keys, including the expired keys which haven't been cleaned up yet.
+func (kd *KeyDir) Len() int {
+	count := 0
+	for _, s := range kd.shards {
+		s.RLock()
+		count += s.keys.Len()
+		s.RUnlock()
 	}
-	defer file.Close()
+	return count
+}
+
+// share returns copy-on-write copies of the B-trees of all the shards at a single point
+// in time. The copies are made in constant time and are never modified after this.
+// If the ordered index is enabled, a copy-on-write copy of it is returned as well.
+func (kd *KeyDir) share() ([]*btree.Map[string, Meta], *btree.Set[string]) {
+	for _, s := range kd.shards {
+		s.Lock()
+	}
+
+	maps := make([]*btree.Map[string, Meta], len(kd.shards))
+	for i, s := range kd.shards {
+		maps[i] = s.keys.Copy()
+	}
+
+	var index *btree.Set[string]
+	if kd.index != nil {
+		kd.indexMu.Lock()
+		index = kd.index.Copy()
+		kd.indexMu.Unlock()
+	}
+
+	for _, s := range kd.shards {
+		s.Unlock()
+	}
+
+	return maps, index
+}
+
+// Range calls fn for every key until it returns false. Each shard is locked
+// while its keys are visited, so fn must not modify the KeyDir.
+func (kd *KeyDir) Range(fn func(k string, meta Meta) bool) {
+	for _, s := range kd.shards {
+		stop := false
+		s.RLock()
+		s.keys.Scan(func(k string, meta Meta) bool {
+			stop = !fn(k, meta)
+			return !stop
+		})
+		s.RUnlock()
+		if stop {
+			return
+		}
+	}
+}
+
+// fileStats tracks the number of bytes of the live records in every datafile, i.e. the
+// records which the keydir points to. The rest of the records in a datafile are garbage
+// which is reclaimed by merging it. The counters are updated as the keydir is modified,
+// so overwriting, deleting and cleaning up expired keys moves their bytes to garbage.
+// The bytes of the tombstones kept by merges are tracked separately, since whether
+// they're garbage depends on the older datafiles.
+type fileStats struct {
+	mu         sync.RWMutex
+	live       map[int]*atomic.Int64
+	tombstones map[int]int64
+}
+
+// add adds n bytes to the live bytes of the datafile.
+func (fs *fileStats) add(id int, n int) {
+	fs.mu.RLock()
+	c, ok := fs.live[id]
+	fs.mu.RUnlock()
+
+	if !ok {
+		fs.mu.Lock()
+		if c, ok = fs.live[id]; !ok {
+			c = new(atomic.Int64)
+			fs.live[id] = c
+		}
+		fs.mu.Unlock()
+	}
+
+	c.Add(int64(n))
+}
+
+// get returns the live bytes of the datafile.
+func (fs *fileStats) get(id int) int64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if c, ok := fs.live[id]; ok {
+		return c.Load()
+	}
+	return 0
+}
+
+// addTombstones adds n bytes to the tombstones kept in the datafile by a merge.
+func (fs *fileStats) addTombstones(id int, n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.tombstones[id] += int64(n)
+}
+
+// getTombstones returns the bytes of the tombstones kept in the datafile by a merge.
+func (fs *fileStats) getTombstones(id int) int64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.tombstones[id]
+}
+
+// drop removes the counters of a datafile which is removed.
+func (fs *fileStats) drop(id int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.live, id)
+	delete(fs.tombstones, id)
+}
+
+// page returns up to n keys of the given shard which are greater than after, in sorted order.
+// done is true if there are no more keys in the shard after the returned ones.
+func (kd *KeyDir) page(shard int, after string, n int) (keys []entry, done bool) {
+	s := kd.shards[shard]
+	s.RLock()
+	defer s.RUnlock()
+
+	done = true
+	s.keys.Ascend(after, func(k string, meta Meta) bool {
+		if k == after {
+			return true
+		}
+		if len(keys) == n {
+			done = false
+			return false
+		}
+		keys = append(keys, entry{key: k, meta: meta})
+		return true
+	})
+	return keys, done
+}
 
-	// Create a new gob decoder.
-	decoder := gob.NewDecoder(file)
+// indexPage returns up to n keys from the ordered index in [start, end) which are greater
+// than after, in sorted order. An empty end means there's no upper bound.
+// done is true if there are no more keys in the range after the returned ones.
+func (kd *KeyDir) indexPage(after, start, end string, n int) (keys []string, done bool) {
+	kd.indexMu.RLock()
+	defer kd.indexMu.RUnlock()
 
-	// Decode the file to the map.
-	err = decoder.Decode(k)
-	if err != nil {
-		return err
+	pivot := after
+	if start > after {
+		pivot = start
 	}
 
-	return nil
+	done = true
+	kd.index.Ascend(pivot, func(k string) bool {
+		if k == after {
+			return true
+		}
+		if end != "" && k >= end {
+			return false
+		}
+		if len(keys) == n {
+			done = false
+			return false
+		}
+		keys = append(keys, k)
+		return true
+	})
+	return keys, done
 }
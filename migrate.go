@@ -0,0 +1,133 @@
+package barrel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
+)
+
+const (
+	MIGRATE_DIR = "migrate"
+)
+
+// Migrate rewrites all the datafiles in the given directory which use an older
+// format version into the current format, in place. Each datafile is first written
+// to a staging directory inside the data directory and then atomically renamed over
+// the original file. The database must not be open while migrating.
+// Encryption keys can be passed as options to read encrypted datafiles and to
+// encrypt the rewritten datafiles. It returns the number of datafiles which were rewritten.
+func Migrate(dir string, cfg ...Config) (int, error) {
+	// Set options.
+	opts := DefaultOptions()
+	for _, opt := range cfg {
+		if err := opt(opts); err != nil {
+			return 0, err
+		}
+	}
+
+	// Acquire the lockfile to ensure no other process is using the directory.
+	lockPath := filepath.Join(dir, LOCKFILE)
+	if exists(lockPath) {
+		return 0, ErrLocked
+	}
+	flockF, err := createFlockFile(lockPath)
+	if err != nil {
+		return 0, fmt.Errorf("error creating lockfile: %w", err)
+	}
+	defer destroyFlockFile(flockF)
+
+	files, err := getDataFiles(dir)
+	if err != nil {
+		return 0, fmt.Errorf("error loading data files: %w", err)
+	}
+	ids, err := getIDs(files)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing ids for existing files: %w", err)
+	}
+
+	// Create a staging directory on the same filesystem so that the rename is atomic.
+	stagingDir := filepath.Join(dir, MIGRATE_DIR)
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	migrated := 0
+	for _, id := range ids {
+		ok, err := migrateFile(opts, dir, stagingDir, id)
+		if err != nil {
+			return migrated, fmt.Errorf("error migrating datafile %d: %w", id, err)
+		}
+		if !ok {
+			continue
+		}
+		migrated++
+
+		// The position of records have changed, so the hints file can't be used anymore.
+		if path := hintsPath(dir, id); exists(path) {
+			if err := os.Remove(path); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateFile rewrites a single datafile in the current format if it uses an older version.
+// Records which were partially written at the end of the datafile are dropped.
+func migrateFile(opts *Options, dir string, stagingDir string, id int) (bool, error) {
+	// The version is checked before looking up the encryption key,
+	// so that datafiles in the current format don't need the key.
+	df, err := datafile.New(dir, id, dataFileOptions(opts)...)
+	if err != nil {
+		return false, err
+	}
+	defer df.Close()
+
+	if df.Version() == datafile.CurrentVersion {
+		return false, nil
+	}
+	if err := loadCipher(opts, df); err != nil {
+		return false, err
+	}
+
+	out, err := openDataFile(opts, stagingDir, id)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+
+	// Re-encode every record in the current format.
+	var buf bytes.Buffer
+	_, err = scan(df, df.Start(), func(record Record, pos int, size int) error {
+		buf.Reset()
+		if err := record.encode(&buf, out.Cipher()); err != nil {
+			return err
+		}
+		_, err := out.Write(buf.Bytes())
+		return err
+	})
+	if err != nil && !errors.Is(err, errTornRecord) {
+		return false, err
+	}
+
+	if err := out.Sync(); err != nil {
+		return false, err
+	}
+
+	// Replace the original datafile.
+	name := fmt.Sprintf(datafile.ACTIVE_DATAFILE, id)
+	if err := os.Rename(filepath.Join(stagingDir, name), filepath.Join(dir, name)); err != nil {
+		return false, err
+	}
+
+	return true, syncDir(dir)
+}
@@ -3,7 +3,6 @@ package barrel
 import (
 	"bytes"
 	"fmt"
-	"hash/crc32"
 	"time"
 
 	"github.com/mr-karan/barreldb/internal/datafile"
@@ -11,19 +10,20 @@ import (
 
 func (b *Barrel) get(k string) (Record, error) {
 	// Check for entry in KeyDir.
-	meta, ok := b.keydir[k]
+	meta, ok := b.keydir.Get(k)
 	if !ok {
 		return Record{}, ErrNoKey
 	}
 
-	var (
-		// Header object for decoding the binary data into it.
-		header Header
-		reader *datafile.DataFile
-	)
+	return b.read(k, meta)
+}
+
+// read reads the record for the key from the datafile using the metadata from the keydir.
+func (b *Barrel) read(k string, meta Meta) (Record, error) {
+	var ok bool
 
 	// Set the current file ID as the default.
-	reader = b.df
+	reader := b.df
 
 	// Check if the ID is different from the current ID.
 	if meta.FileID != b.df.ID() {
@@ -33,102 +33,190 @@ func (b *Barrel) get(k string) (Record, error) {
 		}
 	}
 
+	return readRecord(reader, k, meta)
+}
+
+// readRecord reads the record for the key from the given datafile.
+func readRecord(reader *datafile.DataFile, k string, meta Meta) (Record, error) {
 	// Read the file with the given offset.
 	data, err := reader.Read(meta.RecordPos, meta.RecordSize)
 	if err != nil {
 		return Record{}, fmt.Errorf("error reading data from file: %v", err)
 	}
 
-	// Decode the header.
-	if err := header.decode(data); err != nil {
-		return Record{}, fmt.Errorf("error decoding header: %v", err)
+	// Decode the record after verifying the checksum.
+	record, err := decodeRecord(data, reader.Version(), reader.Cipher())
+	if err != nil {
+		return Record{}, err
 	}
 
-	var (
-		// Get the offset position in record to start reading the value from.
-		valPos = meta.RecordSize - int(header.ValSize)
-		// Read the value from the record.
-		val = data[valPos:]
-	)
-
-	record := Record{
-		Header: header,
-		Key:    k,
-		Value:  val,
+	// Ensure that the record belongs to this key.
+	if record.Key != k {
+		return Record{}, ErrChecksumMismatch
 	}
 
 	return record, nil
 }
 
 func (b *Barrel) put(df *datafile.DataFile, k string, val []byte, expiry *time.Time) error {
+	record, err := b.newRecord(k, val, expiry)
+	if err != nil {
+		return err
+	}
+
+	// Lock the shard of the key while writing, so that the keydir
+	// always points to the record which was appended last for the key.
+	s := b.keydir.shard(k)
+	s.Lock()
+
+	offset, size, err := b.write(df, record)
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+
+	// Add entry to KeyDir.
+	// We just save the value of key and some metadata for faster lookups.
+	// The value is only stored in disk.
+	b.keydir.put(s, k, Meta{
+		Timestamp:  int(record.Header.Timestamp),
+		Expiry:     int(record.Header.Expiry),
+		RecordSize: size,
+		RecordPos:  offset + size,
+		FileID:     df.ID(),
+	})
+	s.Unlock()
+
+	return b.commit(df, offset+size)
+}
+
+// newRecord prepares the record for storing the key and value, compressing the value if required.
+func (b *Barrel) newRecord(k string, val []byte, expiry *time.Time) (Record, error) {
+	// Compress the value with the configured codec.
+	val, codec, err := b.compress(val)
+	if err != nil {
+		return Record{}, err
+	}
+
 	// Prepare header.
 	header := Header{
-		Checksum:  crc32.ChecksumIEEE(val),
-		Timestamp: uint32(time.Now().Unix()),
+		Timestamp: time.Now().UnixMilli(),
 		KeySize:   uint32(len(k)),
 		ValSize:   uint32(len(val)),
 	}
+	header.setCodec(codec)
 
 	// Check for expiry.
 	if expiry != nil {
-		header.Expiry = uint32(expiry.Unix())
+		header.Expiry = expiry.UnixMilli()
 	} else {
 		header.Expiry = 0
 	}
 
 	// Prepare the record.
-	record := Record{
-		Key:   k,
-		Value: val,
-	}
+	return Record{
+		Header: header,
+		Key:    k,
+		Value:  val,
+	}, nil
+}
 
+// write encodes the record and appends it to the datafile.
+// It returns the offset at which the record was written and the size of the record.
+func (b *Barrel) write(df *datafile.DataFile, record Record) (int, int, error) {
 	// Get the buffer from the pool for writing data.
 	buf := b.bufPool.Get().(*bytes.Buffer)
 	defer b.bufPool.Put(buf)
 	// Resetting the buffer is important since the length of bytes written should be reset on each `set` operation.
 	defer buf.Reset()
 
-	// Encode header.
-	header.encode(buf)
+	// Encode header along with the key/value.
+	if err := record.encode(buf, df.Cipher()); err != nil {
+		return -1, -1, fmt.Errorf("error encoding record: %v", err)
+	}
+
+	offset, err := b.append(df, buf.Bytes())
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return offset, buf.Len(), nil
+}
 
-	// Write key/value.
-	buf.WriteString(k)
-	buf.Write(val)
+// append appends the encoded records to the datafile and returns the offset at which they were written.
+func (b *Barrel) append(df *datafile.DataFile, data []byte) (int, error) {
+	// Appends to the datafile are serialized.
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
 
 	// Append to underlying file.
-	offset, err := df.Write(buf.Bytes())
+	offset, err := df.Write(data)
 	if err != nil {
-		return fmt.Errorf("error writing data to file: %v", err)
+		return -1, fmt.Errorf("error writing data to file: %v", err)
 	}
 
-	// Add entry to KeyDir.
-	// We just save the value of key and some metadata for faster lookups.
-	// The value is only stored in disk.
-	b.keydir[k] = Meta{
-		Timestamp:  int(record.Header.Timestamp),
-		RecordSize: len(buf.Bytes()),
-		RecordPos:  offset + len(buf.Bytes()),
-		FileID:     df.ID(),
+	return offset, nil
+}
+
+// commit ensures filesystem's in memory buffer is flushed to disk up to the given
+// position, if configured. It's called without holding the lock of the shard, so
+// that concurrent writers can share a single fsync call in the group commit mode.
+func (b *Barrel) commit(df *datafile.DataFile, pos int) error {
+	if !b.opts.alwaysFSync {
+		return nil
 	}
 
-	// Ensure filesystem's in memory buffer is flushed to disk.
-	if b.opts.alwaysFSync {
-		if err := df.Sync(); err != nil {
-			return fmt.Errorf("error syncing file to disk: %v", err)
-		}
+	var err error
+	if b.opts.groupCommit {
+		err = df.SyncTo(pos)
+	} else {
+		err = df.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("error syncing file to disk: %v", err)
 	}
 
 	return nil
 }
 
 func (b *Barrel) delete(k string) error {
-	// Store an empty tombstone value for the given key.
-	if err := b.put(b.df, k, []byte{}, nil); err != nil {
+	return b.deleteIf(k, nil)
+}
+
+// deleteIf stores a tombstone for the key if the given condition holds for its current
+// metadata. The condition is checked while holding the lock of the shard, so the key can't
+// be modified in between. A nil condition always deletes the key.
+func (b *Barrel) deleteIf(k string, cond func(meta Meta, ok bool) bool) error {
+	// Store a tombstone record for the given key.
+	record := Record{
+		Header: Header{
+			Timestamp: time.Now().UnixMilli(),
+			Flags:     flagTombstone,
+			KeySize:   uint32(len(k)),
+		},
+		Key: k,
+	}
+
+	s := b.keydir.shard(k)
+	s.Lock()
+
+	if cond != nil {
+		meta, ok := s.keys.Get(k)
+		if !cond(meta, ok) {
+			s.Unlock()
+			return nil
+		}
+	}
+
+	offset, size, err := b.write(b.df, record)
+	if err != nil {
+		s.Unlock()
 		return err
 	}
 
 	// Delete it from the map as well.
-	delete(b.keydir, k)
+	b.keydir.remove(s, k)
+	s.Unlock()
 
-	return nil
+	return b.commit(b.df, offset+size)
 }
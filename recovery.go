@@ -0,0 +1,311 @@
+package barrel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
+)
+
+// loadKeyDir populates the keydir during startup.
+// The hints for every datafile are loaded in parallel and applied to the keydir in the
+// order the datafiles were written. Datafiles without a valid hints file are scanned and
+// a hints file is generated for them, so that the next startup doesn't need to scan them.
+func (b *Barrel) loadKeyDir() error {
+	// Remove any temporary hints files left behind by a crash while they were being written.
+	if !b.opts.readOnly {
+		files, err := filepath.Glob(filepath.Join(b.opts.dir, "*.hint.tmp"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(b.stale))
+	for id := range b.stale {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var (
+		// Limit the number of datafiles being loaded at once.
+		sem     = make(chan struct{}, runtime.GOMAXPROCS(0))
+		results = make([]chan fileHints, len(ids))
+		done    = make(chan struct{})
+	)
+	defer close(done)
+
+	for i := range results {
+		results[i] = make(chan fileHints, 1)
+	}
+
+	go func() {
+		for i, id := range ids {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(df *datafile.DataFile, res chan fileHints) {
+				res <- b.loadHints(df)
+			}(b.stale[id], results[i])
+		}
+	}()
+
+	for i, id := range ids {
+		res := <-results[i]
+		<-sem
+
+		df := b.stale[id]
+		if res.err != nil {
+			// A torn write can only happen at the end of the datafile which
+			// was being written to when the process crashed.
+			if !errors.Is(res.err, errTornRecord) || !b.isLastWritten(ids[i+1:]) {
+				return fmt.Errorf("error loading datafile %d: %w", id, res.err)
+			}
+			if err := b.discardTail(df, res.offset); err != nil {
+				return fmt.Errorf("error truncating datafile %d: %w", id, err)
+			}
+		}
+
+		// Tombstones and expired records shouldn't be present in the keydir.
+		for _, h := range res.hints {
+			if h.Tombstone || h.Meta.isExpired() {
+				b.keydir.Delete(h.Key)
+				continue
+			}
+			b.keydir.Set(h.Key, h.Meta)
+		}
+
+		// Generate the hints file for the datafile since it's sealed now.
+		if res.scanned && !b.opts.readOnly {
+			if err := b.saveHints(df, res.offset, res.hints); err != nil {
+				b.lo.Error("error generating hints file", "id", id, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isLastWritten returns true if none of the datafiles with the given IDs have any data.
+// This is used to check whether a datafile was the last one written to before a crash.
+func (b *Barrel) isLastWritten(later []int) bool {
+	for _, id := range later {
+		size, err := b.stale[id].Size()
+		if err != nil || size > int64(b.stale[id].Start()) {
+			return false
+		}
+	}
+	return true
+}
+
+// discardTail truncates the datafile at the given position, discarding
+// any incomplete record written after it. In read only mode, the datafile is left untouched.
+func (b *Barrel) discardTail(df *datafile.DataFile, pos int) error {
+	size, err := df.Size()
+	if err != nil {
+		return err
+	}
+
+	b.lo.Error("discarding incomplete record at the end of datafile", "id", df.ID(), "offset", pos, "discarded_bytes", size-int64(pos))
+	if b.opts.readOnly {
+		return nil
+	}
+
+	return df.Truncate(pos)
+}
+
+// scan reads all the records in the datafile sequentially starting from the
+// given offset and calls fn with each record, the position where the record ends and its size.
+// It returns the position up to which the records were read. If a record is
+// partially written or fails the checksum at the end of the file, errTornRecord is
+// returned along with the position where that record starts.
+//
+// The records of a batch are only passed to fn once the commit marker of the batch
+// is read, so an uncommitted batch is never applied. If the file ends before the commit
+// marker, errTornRecord is returned along with the position where the batch starts.
+func scan(df *datafile.DataFile, offset int, fn func(record Record, pos int, size int) error) (int, error) {
+	fileSize, err := df.Size()
+	if err != nil {
+		return offset, err
+	}
+
+	reader, err := df.Reader(offset)
+	if err != nil {
+		return offset, err
+	}
+
+	var (
+		r       = bufio.NewReader(reader)
+		version = df.Version()
+		aead    = df.Cipher()
+		hdrSize = headerSize(version)
+		hdr     = make([]byte, hdrSize)
+		pos     = offset
+
+		// Records of the batch which is yet to be committed.
+		batch      []scanned
+		batchStart int
+	)
+
+	// torn returns the position from which the incomplete records need to be discarded.
+	torn := func() (int, error) {
+		if len(batch) > 0 {
+			return batchStart, errTornRecord
+		}
+		return pos, errTornRecord
+	}
+
+	for {
+		// Read the header for the next record.
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if errors.Is(err, io.EOF) {
+				if len(batch) > 0 {
+					return torn()
+				}
+				return pos, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return torn()
+			}
+			return pos, err
+		}
+
+		var header Header
+		if err := header.decode(hdr, version); err != nil {
+			return pos, fmt.Errorf("error decoding header: %v", err)
+		}
+
+		// A header with sizes beyond the end of file belongs to an incomplete record,
+		// unless a valid record follows it. Then the sizes are corrupted instead, and
+		// discarding the tail would discard the records after it as well.
+		size := recordSize(header, version, aead)
+		if int64(pos)+int64(size) > fileSize {
+			valid, err := validAfter(df, pos, fileSize)
+			if err != nil {
+				return pos, err
+			}
+			if valid {
+				return pos, fmt.Errorf("%w: record at offset %d", ErrChecksumMismatch, pos)
+			}
+			return torn()
+		}
+
+		// Read the rest of the record.
+		data := make([]byte, size)
+		copy(data, hdr)
+		if _, err := io.ReadFull(r, data[hdrSize:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return torn()
+			}
+			return pos, err
+		}
+
+		record, err := decodeRecord(data, version, aead)
+		if err != nil {
+			// A corrupted record at the end of the file is a torn write. Anywhere else,
+			// the datafile is corrupted and the records after it can't be trusted.
+			if errors.Is(err, ErrChecksumMismatch) {
+				if int64(pos)+int64(size) == fileSize {
+					return torn()
+				}
+				return pos, fmt.Errorf("%w: record at offset %d", ErrChecksumMismatch, pos)
+			}
+			return pos, fmt.Errorf("error decoding record at offset %d: %w", pos, err)
+		}
+
+		start := pos
+		pos += size
+
+		switch {
+		case record.isBatch():
+			if len(batch) == 0 {
+				batchStart = start
+			}
+			batch = append(batch, scanned{record: record, pos: pos, size: size})
+			continue
+
+		case record.isBatchCommit():
+			// Apply the batch only if all of its records are present.
+			if len(record.Value) == 4 && int(binary.LittleEndian.Uint32(record.Value)) == len(batch) {
+				for _, s := range batch {
+					if err := fn(s.record, s.pos, s.size); err != nil {
+						return pos, err
+					}
+				}
+			}
+			batch = batch[:0]
+			continue
+		}
+
+		// A record outside of a batch means that the pending batch was never committed.
+		batch = batch[:0]
+
+		if err := fn(record, pos, size); err != nil {
+			return pos, err
+		}
+	}
+}
+
+// validAfter returns true if a record with a valid checksum starts anywhere after the given position.
+// A torn write only leaves incomplete records at the end of the datafile, so a valid record
+// after a header which extends past the end of the file means that the header is corrupted.
+func validAfter(df *datafile.DataFile, pos int, fileSize int64) (bool, error) {
+	reader, err := df.Reader(pos + 1)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		r       = bufio.NewReader(reader)
+		version = df.Version()
+		aead    = df.Cipher()
+		hdrSize = headerSize(version)
+	)
+
+	for start := pos + 1; int64(start+hdrSize) <= fileSize; start++ {
+		hdr, err := r.Peek(hdrSize)
+		if err != nil {
+			return false, err
+		}
+
+		var header Header
+		if err := header.decode(hdr, version); err == nil {
+			size := recordSize(header, version, aead)
+			if int64(start)+int64(size) <= fileSize {
+				data, err := df.Read(start+size, size)
+				if err != nil {
+					return false, err
+				}
+				if _, err := decodeRecord(data, version, aead); err == nil {
+					return true, nil
+				}
+			}
+		}
+
+		if _, err := r.Discard(1); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// scanned is a record read by scan along with its position and size.
+type scanned struct {
+	record Record
+	pos    int
+	size   int
+}
@@ -0,0 +1,171 @@
+package barrel
+
+import (
+	"fmt"
+
+	"github.com/mr-karan/barreldb/internal/datafile"
+	"github.com/tidwall/btree"
+)
+
+// Snapshot is a read-only view of the datastore at a point in time.
+// Writes made after the snapshot is taken aren't visible in it. The snapshot
+// doesn't hold any lock, so reads from it don't block writes or merges.
+// The datafiles referenced by the snapshot are kept open until it's released.
+// A snapshot is safe for concurrent use.
+type Snapshot struct {
+	barrel *Barrel
+	keydir *KeyDir
+	shards []*btree.Map[string, Meta]
+	index  *btree.Set[string] // Ordered index of the keys. nil if it's disabled.
+	files  map[int]*datafile.DataFile
+}
+
+// Snapshot returns a consistent view of the datastore. The keydir is shared with the
+// snapshot and is copied on write, so neither taking a snapshot nor the writes made
+// while it's in use copy all the keys.
+// Release must be called once the snapshot isn't needed anymore.
+func (b *Barrel) Snapshot() *Snapshot {
+	b.RLock()
+	defer b.RUnlock()
+
+	snap := &Snapshot{
+		barrel: b,
+		keydir: b.keydir,
+		files:  make(map[int]*datafile.DataFile, len(b.stale)+1),
+	}
+	snap.shards, snap.index = b.keydir.share()
+
+	snap.files[b.df.ID()] = b.df
+	for id, df := range b.stale {
+		snap.files[id] = df
+	}
+
+	// Pin the datafiles so that they aren't closed if they're merged.
+	b.pinMu.Lock()
+	for _, df := range snap.files {
+		b.pins[df]++
+	}
+	b.pinMu.Unlock()
+
+	return snap
+}
+
+// Get returns the value of the key at the time the snapshot was taken.
+func (s *Snapshot) Get(k string) ([]byte, error) {
+	if s.shards == nil {
+		return nil, ErrSnapshotReleased
+	}
+
+	meta, ok := s.shards[s.keydir.shardIndex(k)].Get(k)
+	if !ok {
+		return nil, ErrNoKey
+	}
+
+	// Expiry is checked at the time of reading.
+	if meta.isExpired() {
+		return nil, ErrExpiredKey
+	}
+
+	return s.read(k, meta)
+}
+
+// read reads the value of the key from the datafiles pinned by the snapshot.
+func (s *Snapshot) read(k string, meta Meta) ([]byte, error) {
+	df, ok := s.files[meta.FileID]
+	if !ok {
+		return nil, fmt.Errorf("error looking up for the db file for the given id: %d", meta.FileID)
+	}
+
+	record, err := readRecord(df, k, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.value()
+}
+
+// List returns the keys in the snapshot. Expired keys are skipped.
+func (s *Snapshot) List() []string {
+	keys := make([]string, 0, s.Len())
+	s.Fold(func(k string) error {
+		keys = append(keys, k)
+		return nil
+	})
+	return keys
+}
+
+// Len returns the number of keys in the snapshot. Expired keys are not counted.
+func (s *Snapshot) Len() int {
+	count := 0
+	for _, keys := range s.shards {
+		keys.Scan(func(_ string, meta Meta) bool {
+			if !meta.isExpired() {
+				count++
+			}
+			return true
+		})
+	}
+	return count
+}
+
+// Fold iterates over all keys in the snapshot and calls the given function for each key.
+// Expired keys are skipped.
+func (s *Snapshot) Fold(fn func(k string) error) error {
+	var err error
+	for _, keys := range s.shards {
+		keys.Scan(func(k string, meta Meta) bool {
+			if meta.isExpired() {
+				return true
+			}
+			err = fn(k)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release unpins the datafiles used by the snapshot. Datafiles which were merged
+// while the snapshot was in use are closed. The snapshot can't be used after this.
+func (s *Snapshot) Release() error {
+	b := s.barrel
+
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+
+	var err error
+	for _, df := range s.files {
+		b.pins[df]--
+		if b.pins[df] > 0 {
+			continue
+		}
+		delete(b.pins, df)
+
+		if b.retired[df] {
+			delete(b.retired, df)
+			if cerr := df.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+
+	s.shards, s.index, s.files = nil, nil, nil
+
+	return err
+}
+
+// retire closes the datafile which is no longer used by the datastore.
+// If it's pinned by a snapshot, it's closed once all the snapshots using it are released.
+func (b *Barrel) retire(df *datafile.DataFile) error {
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+
+	if b.pins[df] > 0 {
+		b.retired[df] = true
+		return nil
+	}
+
+	return df.Close()
+}
@@ -0,0 +1,183 @@
+package barrel
+
+import (
+	"time"
+)
+
+// Txn is a transaction which reads and writes keys atomically.
+// Transactions are optimistic: the keys aren't locked while the transaction runs.
+// Instead, the version of every key read in the transaction is recorded and verified
+// on commit. If any of them was modified by another write in the meantime, the
+// transaction is aborted with ErrConflict and none of its writes are applied.
+// A transaction is not safe for concurrent use.
+type Txn struct {
+	barrel   *Barrel
+	writable bool
+	snap     *Snapshot // Snapshot which a read-only transaction reads from.
+
+	reads  map[string]version // Versions of the keys read in the transaction.
+	writes map[string]Record  // Latest write for every key in the transaction.
+	batch  *Batch
+}
+
+// version is the state of a key at the time it was read.
+// The metadata of the key in the keydir changes on every write to the key.
+type version struct {
+	meta   Meta
+	exists bool
+}
+
+// Update runs fn in a read-write transaction. The writes in the transaction are
+// committed atomically if fn returns nil. If any key read in the transaction was
+// modified before the commit, ErrConflict is returned and the transaction can be retried.
+// Records moved by a merge are also considered as modified.
+func (b *Barrel) Update(fn func(tx *Txn) error) error {
+	tx := b.newTxn(true)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// View runs fn in a read-only transaction. The keys are read from a snapshot taken when
+// the transaction starts, so fn sees either all or none of the writes of a batch or another
+// transaction, and never conflicts with them.
+func (b *Barrel) View(fn func(tx *Txn) error) error {
+	snap := b.Snapshot()
+	defer snap.Release()
+
+	tx := b.newTxn(false)
+	tx.snap = snap
+	return fn(tx)
+}
+
+func (b *Barrel) newTxn(writable bool) *Txn {
+	tx := &Txn{
+		barrel:   b,
+		writable: writable,
+		reads:    make(map[string]version),
+	}
+	if writable {
+		tx.writes = make(map[string]Record)
+		tx.batch = b.NewBatch()
+	}
+	return tx
+}
+
+// Get returns the value of the key. Writes made earlier in the same transaction are visible.
+func (tx *Txn) Get(k string) ([]byte, error) {
+	if record, ok := tx.writes[k]; ok {
+		if record.isTombstone() {
+			return nil, ErrNoKey
+		}
+		return record.value()
+	}
+
+	if tx.snap != nil {
+		return tx.snap.Get(k)
+	}
+
+	b := tx.barrel
+
+	b.RLock()
+	defer b.RUnlock()
+
+	meta, ok := b.keydir.Get(k)
+
+	// Record the version of the key, even if it doesn't exist, so that
+	// the transaction conflicts with writes creating the key.
+	if _, read := tx.reads[k]; !read {
+		tx.reads[k] = version{meta: meta, exists: ok}
+	}
+
+	if !ok {
+		return nil, ErrNoKey
+	}
+	if meta.isExpired() {
+		return nil, ErrExpiredKey
+	}
+
+	record, err := b.read(k, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.value()
+}
+
+// Put stores the key and value when the transaction is committed.
+func (tx *Txn) Put(k string, val []byte) error {
+	return tx.put(k, val, nil)
+}
+
+// PutEx is same as Put but also takes an additional expiry time.
+func (tx *Txn) PutEx(k string, val []byte, ex time.Duration) error {
+	expiry := time.Now().Add(ex)
+	return tx.put(k, val, &expiry)
+}
+
+func (tx *Txn) put(k string, val []byte, expiry *time.Time) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+
+	if err := tx.batch.put(k, val, expiry); err != nil {
+		return err
+	}
+	tx.writes[k] = tx.batch.records[len(tx.batch.records)-1]
+
+	return nil
+}
+
+// Delete deletes the key when the transaction is committed.
+func (tx *Txn) Delete(k string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+
+	if err := tx.batch.Delete(k); err != nil {
+		return err
+	}
+	tx.writes[k] = tx.batch.records[len(tx.batch.records)-1]
+
+	return nil
+}
+
+// commit verifies that none of the keys read in the transaction were modified
+// and writes all the records of the transaction as a batch.
+func (tx *Txn) commit() error {
+	b := tx.barrel
+
+	b.RLock()
+	defer b.RUnlock()
+
+	if len(tx.batch.records) > 0 && b.opts.readOnly {
+		return ErrReadOnly
+	}
+
+	keys := make([]string, 0, len(tx.reads))
+	for k := range tx.reads {
+		keys = append(keys, k)
+	}
+
+	// If there are no writes, only verify that the reads were consistent.
+	if len(tx.batch.records) == 0 {
+		unlock := b.keydir.lockShards(keys)
+		defer unlock()
+		return tx.validate()
+	}
+
+	return b.writeBatch(tx.batch, keys, tx.validate)
+}
+
+// validate checks that the keys read in the transaction haven't changed since.
+// It's called with the shards of all the keys locked.
+func (tx *Txn) validate() error {
+	for k, v := range tx.reads {
+		meta, ok := tx.barrel.keydir.shard(k).keys.Get(k)
+		if ok != v.exists || meta != v.meta {
+			return ErrConflict
+		}
+	}
+	return nil
+}
@@ -44,6 +44,18 @@ func getIDs(files []string) ([]int, error) {
 	return ids, nil
 }
 
+// syncDir calls fsync(2) on the directory so that any file
+// creation, rename or deletion inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
 // validateKV validates key/value before inserting.
 func validateKV(k string, val []byte) error {
 	if len(k) == 0 {